@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"path"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/pschou/go-flowfile"
+	"github.com/pschou/go-memdiskbuf"
 )
 
 var (
@@ -21,8 +23,10 @@ This utility is intended to take input over a FlowFile compatible port and pass
 FlowFiles into another HTTP/HTTPS port while updating the attributes with the
 certificate and chaining any previous certificates.`
 
-	noChecksum = flag.Bool("no-checksums", false, "Ignore doing checksum checks")
-	hs         *flowfile.HTTPTransaction
+	noChecksum  = flag.Bool("no-checksums", false, "Ignore doing checksum checks")
+	verifyFirst = flag.Bool("verify-first", false, "Buffer each FlowFile and verify the checksum and content policy before\n"+
+		"forwarding any of it, slower than streaming but only verified content leaves the diode")
+	hs *flowfile.HTTPTransaction
 )
 
 func main() {
@@ -31,6 +35,19 @@ func main() {
 	listen_flags()
 	sender_flags()
 	metrics_flags(true)
+	route_flags()
+	policy_flags()
+	spool_flags()
+	authz_flags()
+	client_flags()
+	label_flags()
+	validate_flags()
+	redact_flags()
+	hashlist_flags()
+	clamd_flags()
+	inspect_flags()
+	quarantine_flags()
+	temp_flags()
 	parse()
 	var err error
 
@@ -39,12 +56,28 @@ func main() {
 		return
 	}
 
-	// Connect to the destination to prepare to send files
-	log.Println("Creating sender,", *url)
-
-	// Create a HTTP Transaction with target URL
-	if hs, err = flowfile.NewHTTPTransaction(*url, tlsConfig); err != nil {
-		log.Fatal(err)
+	// Connect to the destinations to prepare to send files
+	loadRoutes(*url)
+	loadPolicy()
+	loadAuthz()
+	client_init()
+	loadLabels()
+	loadValidation()
+	loadRedaction()
+	hashlist_init()
+	clamd_init()
+	inspect_init()
+	spool_init()
+	if *verifyFirst {
+		log.Println("Verifying FlowFiles before forwarding, buffering in", tmpFolder)
+	}
+	hs = defaultRoute.hs
+	if hs == nil {
+		// Everything not routed is rejected, metrics still go to -url
+		log.Println("Creating sender,", *url)
+		if hs, err = flowfile.NewHTTPTransaction(*url, tlsConfig); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	// Configure the go HTTP server
@@ -59,10 +92,10 @@ func main() {
 
 	// Setting up the flow file receiver
 	ffReceiver := flowfile.NewHTTPReceiver(post)
-	http.Handle(*listenPath, ffReceiver)
+	http.Handle(*listenPath, authHandler(clientHandler(ffReceiver)))
 
 	// Setup a timer to update the maximums and minimums for the sender
-	handshaker(hs, ffReceiver)
+	handshakers(routeTransactions(), ffReceiver)
 	send_metrics("DIODE", func(f *flowfile.File) { hs.Send(f) }, ffReceiver.Metrics)
 
 	// Open the local port to listen for incoming connections
@@ -80,24 +113,62 @@ func post(rdr *flowfile.Scanner, w http.ResponseWriter, r *http.Request) {
 	var err error
 	var f *flowfile.File
 
-	httpWriter := hs.NewHTTPPostWriter()
+	// In strict mode, or when the content is inspected, each FlowFile is held
+	// in a buffer until it is verified
+	var buf *memdiskbuf.Buffer
+	if *verifyFirst || scanning() || inspecting() || validate != nil || redact != nil || hashLists() {
+		buf = bufPool.Get().(*memdiskbuf.Buffer)
+		defer func() { buf.Reset(); bufPool.Put(buf) }()
+	}
+	var out *memdiskbuf.Buffer
+	if redact != nil {
+		out = bufPool.Get().(*memdiskbuf.Buffer)
+		defer func() { out.Reset(); bufPool.Put(out) }()
+	}
+
+	// Posts are opened to the downstreams as FlowFiles are routed to them
+	var posts []*routePost
+	postFor := func(rt *route) *routePost {
+		for _, rp := range posts {
+			if rp.rt == rt {
+				return rp
+			}
+		}
+		rp := rt.open(r)
+		posts = append(posts, rp)
+		return rp
+	}
 
 	defer func() {
+		if err != nil {
+			for _, rp := range posts {
+				rp.terminate()
+			}
+			if pe, ok := err.(*policyError); ok {
+				// Let the sender know why the FlowFile was refused
+				who := r.RemoteAddr
+				if dn := peerSubject(r); dn != "" {
+					who += " (" + dn + ")"
+				}
+				log.Println("  Rejected from", who+":", pe.reason)
+				replyError(w, pe)
+			} else {
+				log.Println("err:", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		for _, rp := range posts {
+			if cerr := rp.close(); cerr != nil {
+				rp.rt.markDown(cerr)
+				err = cerr
+			}
+		}
 		if err != nil {
 			log.Println("err:", err)
-			httpWriter.Terminate()
 			w.WriteHeader(http.StatusInternalServerError)
 		} else {
-			httpWriter.Close()
-			if httpWriter.Response == nil {
-				err = fmt.Errorf("File did not send, no response")
-				w.WriteHeader(http.StatusInternalServerError)
-			} else if httpWriter.Response.StatusCode != 200 {
-				err = fmt.Errorf("File did not send successfully, Server replied: %s", httpWriter.Response.Status)
-				w.WriteHeader(http.StatusInternalServerError)
-			} else {
-				w.WriteHeader(http.StatusOK)
-			}
+			w.WriteHeader(http.StatusOK)
 		}
 	}()
 
@@ -111,20 +182,130 @@ func post(rdr *flowfile.Scanner, w http.ResponseWriter, r *http.Request) {
 
 		// Flatten directory for ease of viewing
 		dir := filepath.Clean(f.Attrs.Get("path"))
+		filename := f.Attrs.Get("filename")
+
+		// Make sure this client may send this FlowFile
+		var rule *authRule
+		if rule, err = authorize(f, r); err != nil {
+			return
+		}
+		if err = clientCharge(f, r); err != nil {
+			return
+		}
+
+		// Pick the downstream by the attributes as they arrived
+		rt := findRoute(f.Attrs)
+		if rt.Reject {
+			err = rejectf(http.StatusForbidden, "Rejected %q by route %s", path.Join(dir, filename), rt.Name)
+			return
+		}
+
+		// Only pass what this diode and client are cleared for
+		if labels != nil {
+			if err = labels.check(f, r); err != nil {
+				return
+			}
+		}
+
+		// Enforce the content policy, orig is the FlowFile as it was received
+		orig := f
+		if policy != nil {
+			if orig, err = policy.checkFlowFile(f); err != nil {
+				return
+			}
+		}
 
 		// Make sure the client chain is added to attributes, 1 being the closest
 		updateChain(f, r, "DIODE")
+		rule.record(f)
+
+		// Verify the whole FlowFile before any of it is sent on
+		check := func() error { return verify(orig) }
+		if buf != nil {
+			if f, err = buffered(f, buf, check); err != nil {
+				return
+			}
+			check = func() error { return nil }
+		}
+
+		// Scan the verified content for malware
+		if scanning() {
+			err = scanFlowFile(f, buf)
+			buf.Rewind()
+			if err != nil {
+				if f.Attrs.Get("scan.result") == "FOUND" {
+					quarantineWrite(f, err.Error())
+				}
+				return
+			}
+		}
+
+		// Refuse known bad content, or anything not approved when strict.  Only
+		// whole files can be looked up, segments are left to the receiver.
+		if hashLists() {
+			if f.Attrs.Get("fragment.index") != "" {
+				if *hashStrict {
+					err = rejectf(http.StatusForbidden, "Segmented %q cannot be checked against the allowlist", filename)
+					return
+				}
+			} else {
+				var blocked bool
+				blocked, err = hashCheck(f, buf)
+				buf.Rewind()
+				if err != nil {
+					if blocked {
+						quarantineWrite(f, err.Error())
+					}
+					return
+				}
+			}
+		}
+
+		// Open archives and hold every member to the policy and scan
+		if inspecting() {
+			err = inspectFlowFile(f, buf)
+			buf.Rewind()
+			if err != nil {
+				if f.Attrs.Get("scan.result") == "FOUND" {
+					quarantineWrite(f, err.Error())
+				}
+				return
+			}
+		}
+
+		// Make sure structured content is well formed and valid
+		if validate != nil {
+			err = validate.check(f, buf)
+			buf.Rewind()
+			if err != nil {
+				if validate.Quarantine {
+					quarantineWrite(f, err.Error())
+				}
+				return
+			}
+		}
+
+		// Strip identifiers out of text before it leaves
+		if redact != nil {
+			if f, err = redact.apply(f, buf, out); err != nil {
+				return
+			}
+		}
+
+		// Hold onto the FlowFile while the downstream is unavailable
+		if rt.spooling() {
+			fmt.Printf("  Spooling file %s for %s\n", path.Join(dir, filename), r.RemoteAddr)
+			if err = spoolWrite(rt, f, check); err != nil {
+				return
+			}
+			continue
+		}
 
 		// Send the flowfile to the next HTTP/HTTPS port, if the send fails, it
 		// will come back with an error and this in turn will be passed back to the
 		// sender side.  All this is done without allowing any bytes to transfer
 		// from the receiver side to the sender side.
-		if xForwardFor := r.Header.Get("X-Forwarded-For"); xForwardFor != "" {
-			httpWriter.Header.Set("X-Forwarded-For", r.RemoteAddr+","+xForwardFor)
-		} else {
-			httpWriter.Header.Set("X-Forwarded-For", r.RemoteAddr)
-		}
-		filename := f.Attrs.Get("filename")
+		rp := postFor(rt)
 
 		if id := f.Attrs.Get("fragment.index"); id != "" {
 			i, _ := strconv.Atoi(id)
@@ -133,26 +314,57 @@ func post(rdr *flowfile.Scanner, w http.ResponseWriter, r *http.Request) {
 		} else {
 			fmt.Printf("  Dioding file %s for %s\n", path.Join(dir, filename), r.RemoteAddr)
 		}
-
 		if *verbose {
+			if len(routes) > 1 {
+				fmt.Printf("    Route %s to %s\n", rt.Name, rt.URL)
+			}
 			adat, _ := json.Marshal(f.Attrs)
 			fmt.Printf("    %s\n", adat)
 		}
 
-		_, err = httpWriter.Write(f)
-
-		if err == nil && !*noChecksum {
-			err = f.Verify()
-			if err == flowfile.ErrorChecksumMissing {
-				if *verbose && f.Size > 0 {
-					log.Println("    No checksum found for", filename)
-				}
-				err = nil
-			}
+		if err = rp.write(f); err == nil {
+			err = check()
 		}
 		if err != nil {
+			if _, ok := err.(*policyError); !ok && err != flowfile.ErrorChecksumMismatch {
+				rt.markDown(err)
+			}
 			return
 		}
 	}
 	err = rdr.Err() // Pick up any reader errors
 }
+
+// verify checks the FlowFile content against the checksum, unless disabled
+func verify(f *flowfile.File) (err error) {
+	if *noChecksum {
+		return nil
+	}
+	if err = f.Verify(); err == flowfile.ErrorChecksumMissing {
+		if *verbose && f.Size > 0 {
+			log.Println("    No checksum found for", f.Attrs.Get("filename"))
+		}
+		err = nil
+	}
+	return
+}
+
+// buffered reads the content of a FlowFile into the buffer and returns a
+// FlowFile replaying it, only once the content has passed the check.
+func buffered(f *flowfile.File, buf *memdiskbuf.Buffer, check func() error) (*flowfile.File, error) {
+	buf.Reset()
+	if _, err := io.Copy(buf, f); err != nil {
+		return nil, err
+	}
+	if err := check(); err != nil {
+		return nil, err
+	}
+	if *verbose {
+		log.Println("    Verified", f.Attrs.Get("filename"), "before forwarding")
+	}
+
+	// Only the Reader is exposed so the buffer is read through in order
+	ff := flowfile.New(struct{ io.Reader }{buf}, f.Size)
+	ff.Attrs = f.Attrs
+	return ff, nil
+}
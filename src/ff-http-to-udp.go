@@ -35,10 +35,13 @@ is maintained by adding an action field with "HTTP-TO-UDP" value.
 Note: The port range used in the source UDP address directly affect the number
 of concurrent sessions.
 
-The resend-delay will add latency (by delaying new connections until second
-send is complete) but will add error resilience in the transfer.  In other
-words, shortening the delay will likely mean more errors, while increaing will
-slow down the number of accepted HTTP connections upstream.`
+Lost packets are rebuilt on the receiving side from the Reed-Solomon parity
+sent after every block of chunks, set by -fec as data:parity chunks per block,
+with -fec-interleave blocks sharing a span of the payload.
+When losses come in bursts longer than the parity can cover, a resend-delay
+may be set to send the whole payload a second time.  This will add latency (by
+delaying new connections until the second send is complete) and doubles the
+bandwidth used.`
 
 	//noChecksum = flag.Bool("no-checksums", false, "Ignore doing checksum checks")
 	//udpSrcInt  = flag.String("udp-src-int", "ens192", "Interface where to send UDP packets")
@@ -48,7 +51,10 @@ slow down the number of accepted HTTP connections upstream.`
 		"Source IP:PORT for originating, IE split range: :3100-3104,3106-3110")
 	//udpDstMac  = flag.String("udp-dst-mac", "6c:3b:6b:ed:78:14", "Target MAC for UDP packet (only needed using raw)")
 	//udpSrcMac  = flag.String("udp-src-mac", "00:0c:29:69:bd:3d", "Source MAC for UDP packet (only needed using raw)")
-	resend         = flag.Duration("resend-delay", time.Second/3, "Time between first transmit and second, set to 0s to disable.")
+	resend         = flag.Duration("resend-delay", 0, "Time between first transmit and a second one, 0s sends once")
+	fecSpec        = flag.String("fec", "20:4", "Forward error correction as data:parity chunks per block, 0 to disable")
+	fecDepth       = flag.Int("fec-interleave", 8, "Number of blocks interleaved to spread out a burst of lost packets")
+	udpVersion     = flag.Int("udp-version", 1, "Packet header version, 2 adds a CRC to each packet once the receivers are updated")
 	maxConnections = flag.Int("max-http-sessions", 1000, "Limit the number of allowed concurrent incoming HTTP connections")
 	connTimeout    = flag.Duration("http-timeout", 10*time.Hour, "Limit the number total upload time")
 	threads        = flag.Int("threads", 10, "Parallel concurrent uploads")
@@ -70,6 +76,8 @@ slow down the number of accepted HTTP connections upstream.`
 		"The value can be tuned (like -120 to 120). Frames are sent less frequently with a larger value.")
 	throttleShared = flag.Bool("throttle-shared", false, "By default each thread is throttled, instead throttle all threads as one. Not recommended")
 
+	fecData, fecParity int
+
 	hash        = flag.String("hash", "SHA1", "Hash to use in checksum value")
 	addChecksum = flag.Bool("add-checksum", false, "Add a checksum to the attributes (if missing)")
 	swg         sizedwaitgroup.SizedWaitGroup
@@ -90,6 +98,16 @@ func main() {
 	swg = sizedwaitgroup.New(*threads)
 
 	var err error
+	if *udpVersion < 1 || *udpVersion > ffVersion {
+		log.Fatal("Unsupported udp-version ", *udpVersion)
+	}
+	if fecData, fecParity, err = parseFEC(*fecSpec, *fecDepth); err != nil {
+		log.Fatal(err)
+	}
+	if fecData > 0 {
+		log.Printf("Sending %d parity chunks for every %d data chunks, interleaved %d deep\n", fecParity, fecData, *fecDepth)
+	}
+
 	throttle, err = bunit.ParseBitRate(*throttleStr)
 	if err != nil {
 		log.Fatal(err)
@@ -171,13 +189,21 @@ func post(f *flowfile.File, w http.ResponseWriter, r *http.Request) (err error)
 	// Make sure the client chain is added to attributes, 1 being the closest
 	updateChain(f, r, "HTTP-TO-UDP")
 
+	hdrLen := ffHeaderLen(*udpVersion)
+
+	// Parity packets carry a small header, so the chunks are made smaller
+	toCopy := maxPayloadSize - hdrLen
+	if fecData > 0 {
+		toCopy -= fecHeaderSize
+	}
+
 	// Send initial wakeup packet for allocation of job remotely
 	id, _ := uuid.Parse(f.Attrs.Get("uuid"))
 	hdr := ffHeader{
 		UUID:   id,
 		Size:   uint64(f.HeaderSize()) + uint64(f.Size),
 		Offset: 0,
-		MTU:    uint16(maxPayloadSize) - uint16(ffHeaderSize),
+		MTU:    uint16(toCopy),
 	}
 
 	if *debug {
@@ -185,12 +211,11 @@ func post(f *flowfile.File, w http.ResponseWriter, r *http.Request) (err error)
 	}
 	{ // Write out the initial header
 		var initBuf bytes.Buffer
-		binary.Write(&initBuf, binary.BigEndian, &hdr)
+		writeHeader(&initBuf, *udpVersion, 0, &hdr)
+		sealPacket(initBuf.Bytes(), *udpVersion)
 		wk.conn.WriteTo(initBuf.Bytes(), wk.dst) // Send an empty payload
 	}
 
-	toCopy := maxPayloadSize - int(ffHeaderSize)
-
 	// Flatten directory for ease of log viewing
 	dir := filepath.Clean(f.Attrs.Get("path"))
 	filename = f.Attrs.Get("filename")
@@ -269,8 +294,8 @@ func post(f *flowfile.File, w http.ResponseWriter, r *http.Request) (err error)
 	swg.Add()
 	defer swg.Done()
 
-	//firstSend := time.Now()
-	{ // First send
+	// Send the payload, with the parity after every block of chunks
+	send := func() (err error) {
 		// Create output file handle
 		f1 := flowfile.New(wk.buf, wk.buf.Cap())
 		f1.Attrs = f.Attrs
@@ -279,78 +304,95 @@ func post(f *flowfile.File, w http.ResponseWriter, r *http.Request) (err error)
 		rdr1 := f1.EncodedReader()
 		hdr1 := hdr
 
+		var shards [][][]byte
+		depth := *fecDepth
+		if fecData > 0 {
+			shards = make([][][]byte, depth)
+			for b := range shards {
+				shards[b] = make([][]byte, fecData+fecParity)
+				for i := range shards[b] {
+					shards[b][i] = make([]byte, toCopy)
+				}
+			}
+		}
+		total := int(hdr.Size-1)/toCopy + 1
+
 		// Write out the payload
 		var writeBuf bytes.Buffer
 		var a int64
-		var b int
+		var b, k, group int
 		hdr1.Offset = 0
 		var copy_err error
 		for copy_err == nil && isOpen {
-			binary.Write(&writeBuf, binary.BigEndian, &hdr1)
+			writeHeader(&writeBuf, *udpVersion, 0, &hdr1)
 			a, copy_err = io.CopyN(&writeBuf, rdr1, int64(toCopy))
-			//if *debug {
-			//	fmt.Println("copy:", a, copy_err)
-			//}
+			sealPacket(writeBuf.Bytes(), *udpVersion)
 			<-wk.throttler.C
 			if b, err = wk.conn.WriteTo(writeBuf.Bytes(), wk.dst); err != nil {
 				return
 			}
-			if int(a)+int(ffHeaderSize) != b {
-				err = fmt.Errorf("Buffer to packet size error %d != %d", a, b)
-				return
+			if int(a)+hdrLen != b {
+				return fmt.Errorf("Buffer to packet size error %d != %d", a, b)
 			}
 			hdr1.Offset += uint64(toCopy)
+
+			// Keep the chunk for the parity and send it once the group is full
+			if shards != nil && a > 0 {
+				shard := fecShard(shards, k)
+				n := copy(shard, writeBuf.Bytes()[hdrLen:])
+				for i := n; i < toCopy; i++ {
+					shard[i] = 0
+				}
+				k++
+			}
 			writeBuf.Reset()
+			if shards != nil && (k == fecData*depth || copy_err != nil && k > 0) {
+				if err = sendParity(wk, hdr, shards, k, total, group); err != nil {
+					return
+				}
+				k, group = 0, group+1
+			}
 		}
 
 		if copy_err != io.EOF {
-			err = copy_err
-			return
+			return copy_err
 		}
+		return nil
 	}
-	if !isOpen {
+
+	if err = send(); err != nil || !isOpen || *resend == 0 {
 		return
 	}
 	time.Sleep(*resend)
+	return send()
+}
 
-	//if *debug {
-	//	fmt.Println("  resending ", filename)
-	//}
-
-	// Create output file handle
-	f1 := flowfile.New(wk.buf, wk.buf.Cap())
-	f1.Attrs = f.Attrs
-
-	// Read the FlowFile through an EncodedReader for dropping on the wire
-	rdr1 := f1.EncodedReader()
-	hdr1 := hdr
+// sendParity computes and sends the parity of a group of k chunks, the chunks
+// past the end of the payload are zeros.  The packets go out a parity index at
+// a time across the blocks so a burst of losses is spread out as well.
+func sendParity(wk *worker, hdr ffHeader, shards [][][]byte, k, total, group int) error {
+	if err := fecEncodeGroup(shards, k, fecData, fecParity); err != nil {
+		return err
+	}
+	depth := len(shards)
 
-	// Write out the payload
 	var writeBuf bytes.Buffer
-	var a int64
-	var b int
-	hdr1.Offset = 0
-	var copy_err error
-	for copy_err == nil && isOpen {
-		binary.Write(&writeBuf, binary.BigEndian, &hdr1)
-		a, copy_err = io.CopyN(&writeBuf, rdr1, int64(toCopy))
-		<-wk.throttler.C
-		if b, err = wk.conn.WriteTo(writeBuf.Bytes(), wk.dst); err != nil {
-			return
-		}
-		if int(a)+int(ffHeaderSize) != b {
-			err = fmt.Errorf("Buffer to packet size error %d != %d", a, b)
-			return
+	fh := fecHeader{Data: uint16(fecData), Parity: uint16(fecParity), Depth: uint16(depth)}
+	for p := 0; p < fecParity; p++ {
+		for b, block := range shards {
+			hdr.Offset = uint64(fecParityChunk(total, group*depth+b, p, fecParity)) * uint64(hdr.MTU)
+			writeHeader(&writeBuf, *udpVersion, ffFlagParity, &hdr)
+			binary.Write(&writeBuf, binary.BigEndian, &fh)
+			writeBuf.Write(block[fecData+p])
+			sealPacket(writeBuf.Bytes(), *udpVersion)
+			<-wk.throttler.C
+			if _, err := wk.conn.WriteTo(writeBuf.Bytes(), wk.dst); err != nil {
+				return err
+			}
+			writeBuf.Reset()
 		}
-		hdr1.Offset += uint64(toCopy)
-		writeBuf.Reset()
 	}
-
-	// Keep the channel open for a hot second to let buffers flush out
-	//if *debug {
-	//	fmt.Println("sent", filename)
-	//}
-	return
+	return nil
 }
 
 type worker struct {
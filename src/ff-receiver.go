@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -38,6 +40,13 @@ func main() {
 	service_flags()
 	listen_max()
 	listen_flags()
+	cas_flags()
+	tenant_flags()
+	authz_flags()
+	browse_flags()
+	extract_flags()
+	hashlist_flags()
+	quarantine_flags()
 	parse()
 
 	if len(flag.Args()) != 0 {
@@ -46,6 +55,11 @@ func main() {
 	}
 
 	fmt.Println("Output set to", *basePath)
+	cas_init()
+	loadTenants(*listenPath)
+	loadAuthz()
+	hashlist_init()
+	browse_start(*basePath)
 
 	// Configure the go HTTP server
 	server := &http.Server{
@@ -58,8 +72,26 @@ func main() {
 	}
 
 	// Setting up the FlowFile receiver
-	ffReceiver := flowfile.NewHTTPFileReceiver(post)
-	http.Handle(*listenPath, ffReceiver)
+	ffReceiver := flowfile.NewHTTPReceiver(func(rdr *flowfile.Scanner, w http.ResponseWriter, r *http.Request) {
+		for rdr.Scan() {
+			if err := post(rdr.File(), w, r); err != nil {
+				// Let the sender know why a FlowFile was refused
+				var pe *policyError
+				if errors.As(err, &pe) {
+					replyError(w, pe)
+				} else {
+					w.WriteHeader(http.StatusNotAcceptable)
+				}
+				return
+			}
+		}
+		if err := rdr.Err(); err == nil || err == io.EOF {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	tenantHandle(*listenPath, authHandler(ffReceiver))
 
 	// Setup a timer to update the maximums and minimums for the sender
 	handshaker(hs, ffReceiver)
@@ -81,6 +113,30 @@ func post(f *flowfile.File, w http.ResponseWriter, r *http.Request) (err error)
 		}
 	}()
 
+	// Determine where the output goes, either the base path or the tenant's
+	root, hook := *basePath, *script
+	t := getTenant(r)
+	if t != nil {
+		root = t.Path
+		if t.Script != "" {
+			hook = t.Script
+		}
+	} else if len(tenants) > 0 && r != nil {
+		err = fmt.Errorf("No tenant matched for %s", r.RemoteAddr)
+		return
+	}
+
+	// Make sure this client may send this FlowFile, recording the rule
+	var rule *authRule
+	if rule, err = authorize(f, r); err != nil {
+		err = fmt.Errorf("Rejected from %s: %w", r.RemoteAddr, err)
+		return
+	}
+	if rule != nil {
+		updateChain(f, r, "RECEIVER")
+		rule.record(f)
+	}
+
 	// Save the flowfile into the base path with the file structure defined by
 	// the flowfile attributes.
 	dir := filepath.Clean(f.Attrs.Get("path"))
@@ -89,8 +145,8 @@ func post(f *flowfile.File, w http.ResponseWriter, r *http.Request) (err error)
 		return
 	}
 	filename := f.Attrs.Get("filename")
-	fp := path.Join(*basePath, dir, filename)
-	err = os.MkdirAll(path.Join(*basePath, dir), 0755)
+	fp := path.Join(root, dir, filename)
+	err = os.MkdirAll(path.Join(root, dir), 0755)
 	if err != nil {
 		return
 	}
@@ -109,9 +165,32 @@ func post(f *flowfile.File, w http.ResponseWriter, r *http.Request) (err error)
 	switch kind := f.Attrs.Get("kind"); kind {
 	case "file", "":
 		log.Println("  Receiving flowfile", fp, "size", f.Size)
+		// Bytes held against the quota are handed back unless the file is kept,
+		// kept being the size of the whole file once segments are put together
+		held, kept := f.Size, f.Size
+		if t != nil {
+			if err = t.reserve(f.Size); err != nil {
+				return
+			}
+			defer func() {
+				if err != nil && held == 0 {
+					held = f.Size
+				}
+				t.release(held)
+			}()
+		}
 
-		// Safe off the file
-		_, err = f.Save(*basePath)
+		// Safe off the file, whole files go straight into the object store while
+		// segments are assembled in place and moved once the parent is verified
+		useCAS := *casPath != "" && f.Size > 0
+		if useCAS && f.Attrs.Get("fragment.index") == "" {
+			var dup bool
+			if _, dup, err = casSave(f, fp); err == nil && !dup {
+				held = 0
+			}
+		} else if _, err = f.Save(root); err == nil {
+			held = 0
+		}
 		if err == nil {
 			if id := f.Attrs.Get("fragment.index"); id != "" {
 				i, _ := strconv.Atoi(id)
@@ -127,18 +206,65 @@ func post(f *flowfile.File, w http.ResponseWriter, r *http.Request) (err error)
 				}
 				log.Println("  Verified segmented file", fp)
 				os.Remove(fp + ".progress")
+				if fi, serr := os.Stat(fp); serr == nil {
+					kept = fi.Size()
+				}
+				if useCAS {
+					var obj string
+					if obj, err = casHashFile(fp); err != nil {
+						return
+					}
+					var dup bool
+					if dup, err = casCommit(fp, obj, fp, f); err != nil {
+						return
+					} else if dup {
+						held = kept
+					}
+				}
 			} else {
 				log.Printf("  Verified file %s\n", fp)
 			}
 
+			target := casResolve(fp)
+
+			// Refuse known bad content, or anything not approved when strict
+			if hashLists() {
+				if err = hashCheckFile(f, target); err != nil {
+					if useCAS {
+						casRemove(fp)
+					} else {
+						os.Remove(fp)
+					}
+					held = kept
+					err = fmt.Errorf("Rejected from %s: %w", r.RemoteAddr, err)
+					return
+				}
+			}
+			recordReceipt(t, root, fp, f.Attrs)
+
+			// Unpack archives beside the received file
+			if *extract {
+				if dest, err := extractArchive(target, fp); err != nil {
+					log.Println("  Unable to extract", fp, err)
+				} else if dest != "" && *extractRemove {
+					if useCAS {
+						casRemove(fp)
+					} else {
+						os.Remove(fp)
+					}
+					log.Printf("  Removed %s (extracted)\n", fp)
+					held, target = kept-dirSize(dest), dest // The extracted files are kept instead
+				}
+			}
+
 			// If a script file is provided, call it
-			if *script != "" {
-				log.Println("  Calling script", *scriptShell, *script, fp)
-				output, err := exec.Command(*scriptShell, *script, fp).Output()
+			if hook != "" {
+				log.Println("  Calling script", *scriptShell, hook, target)
+				output, err := exec.Command(*scriptShell, hook, target).Output()
 				if *verbose {
-					log.Println("----- START", *script, fp, "-----")
+					log.Println("----- START", hook, target, "-----")
 					fmt.Println(string(output))
-					log.Println("----- END", *script, fp, "-----")
+					log.Println("----- END", hook, target, "-----")
 					if err != nil {
 						log.Printf("error %s", err)
 					}
@@ -146,13 +272,25 @@ func post(f *flowfile.File, w http.ResponseWriter, r *http.Request) (err error)
 
 				// If the removal of the file is requested
 				if *remove {
-					os.Remove(fp)
+					if useCAS {
+						casRemove(fp)
+					} else {
+						os.Remove(fp)
+					}
+					if held == 0 {
+						held = kept
+					}
 					if *verbose {
 						log.Printf("  Removed %s\n", fp)
 					}
 				}
 			}
 		}
+
+		// Stored objects are shared, so leave their mode and times alone
+		if useCAS {
+			return
+		}
 		if unixMode != nil {
 			unixmode.Chmod(fp, *unixMode)
 		}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/pschou/go-bunit"
 	"github.com/pschou/go-flowfile"
 )
 
@@ -27,6 +32,11 @@ var (
 	scriptShell      = flag.String("script-shell", "/bin/bash", "Shell to be used for script run")
 	remove           = flag.Bool("rm", false, "Automatically remove file after script has finished")
 	removeIncomplete = flag.Bool("rm-partial", true, "Automatically remove partial files\nTo unset this default use -rm-partial=false .")
+	fsync            = flag.Bool("fsync", false, "Sync staged files and the directory to disk before replying to the sender")
+	bundleMaxSize    = flag.String("bundle-max-size", "", "Append incoming FlowFiles to an open bundle and roll over once it reaches this size (example 1GB)")
+	bundleMaxCount   = flag.Int("bundle-max-count", 0, "Roll over the open bundle once it holds this many FlowFiles")
+	bundleMaxAge     = flag.Duration("bundle-max-age", 0, "Roll over the open bundle once it has been open this long (example 5m)")
+	quarantine       = flag.String("quarantine", "", "Directory in which to move damaged staged files found on startup (default is path/quarantine)")
 	hs               *flowfile.HTTPTransaction
 )
 
@@ -34,6 +44,7 @@ func main() {
 	service_flags()
 	listen_flags()
 	listen_max()
+	authz_flags()
 	parse()
 
 	if len(flag.Args()) != 0 {
@@ -42,6 +53,12 @@ func main() {
 	}
 
 	fmt.Println("Output set to", *basePath)
+	if *quarantine == "" {
+		*quarantine = path.Join(*basePath, "quarantine")
+	}
+	loadAuthz()
+	recoverStaged()
+	bundle_init()
 
 	// Configure the go HTTP server
 	server := &http.Server{
@@ -55,7 +72,7 @@ func main() {
 
 	// Setting up the flow file receiver
 	ffReceiver := flowfile.NewHTTPReceiver(post)
-	http.Handle(*listenPath, ffReceiver)
+	http.Handle(*listenPath, authHandler(ffReceiver))
 
 	// Setup a timer to update the maximums and minimums for the sender
 	handshaker(nil, ffReceiver)
@@ -78,22 +95,60 @@ func post(s *flowfile.Scanner, w http.ResponseWriter, r *http.Request) {
 	outputDat := output + ".dat"
 	outputTemp := output + ".inprogress"
 	outputAttrs := output + ".json"
+	if bundling {
+		// Stage the post on the side until it is verified and can be appended
+		outputDat = output + ".incoming"
+	}
 
 	var err error
 	var attrSlice []flowfile.Attributes
 	var fh, fha *os.File
 	defer func() {
+		if bundling {
+			if fh != nil {
+				fh.Close()
+			}
+			if err == nil {
+				err = bundleAppend(outputDat, attrSlice)
+			}
+			os.Remove(outputDat)
+			if err == nil {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				log.Println("  Failed staging", uuid, err)
+				replyError(w, err)
+			}
+			return
+		}
+
+		if err == nil && *fsync {
+			// Make sure the payload and attributes are on disk before committing
+			if err = fh.Sync(); err == nil {
+				err = fha.Sync()
+			}
+		}
 		if fha != nil {
 			fha.Close() // Make sure file is closed at the end of the function
 		}
 		if fh != nil {
 			fh.Close() // Make sure file is closed at the end of the function
 		}
+		if _, ok := err.(*policyError); ok {
+			// Nothing of a refused post is kept
+			os.Remove(outputDat)
+			os.Remove(outputTemp)
+		}
+		if err == nil {
+			err = os.Rename(outputTemp, outputAttrs)
+		}
+		if err == nil && *fsync {
+			err = syncDir(*basePath)
+		}
 		if err == nil {
-			os.Rename(outputTemp, outputAttrs)
 			w.WriteHeader(http.StatusOK)
 		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("  Failed staging", uuid, err)
+			replyError(w, err)
 		}
 	}()
 
@@ -102,16 +157,25 @@ func post(s *flowfile.Scanner, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	enc := flowfile.NewWriter(fh)
-	if fha, err = os.Create(outputTemp); err != nil {
-		return
+	if !bundling {
+		if fha, err = os.Create(outputTemp); err != nil {
+			return
+		}
 	}
 
 	var f *flowfile.File
 	for s.Scan() {
 		f = s.File()
 
+		// Make sure this client may send this FlowFile
+		var rule *authRule
+		if rule, err = authorize(f, r); err != nil {
+			return
+		}
+
 		// Make sure the client chain is added to attributes, 1 being the closest
 		updateChain(f, r, "TO-DISK")
+		rule.record(f)
 
 		fmt.Println("  Receiving file", f.Attrs.Get("filename"), "size", f.Size)
 		if *verbose {
@@ -126,40 +190,325 @@ func post(s *flowfile.Scanner, w http.ResponseWriter, r *http.Request) {
 		if err = f.Verify(); err != nil {
 			if *removeIncomplete {
 				os.Remove(outputDat)
-				os.Remove(outputAttrs)
+				os.Remove(outputTemp)
 				log.Printf("  Removed %s (unverified)\n", uuid)
 			}
 			return
 		}
 
-		if *script != "" {
-			log.Println("  Calling script", *scriptShell, *script, outputDat, outputAttrs)
-			output, err := exec.Command(*scriptShell, *script, outputDat, outputAttrs).Output()
-			if *verbose {
-				log.Println("----- START", *script, uuid, "-----")
-				fmt.Println(string(output))
-				log.Println("----- END", *script, uuid, "-----")
-				if err != nil {
-					log.Printf("error %s", err)
+		if *script != "" && !bundling {
+			runScript(uuid, outputDat, outputAttrs)
+		}
+
+		f.Attrs.Set("size", fmt.Sprintf("%d", f.Size))
+		attrSlice = append(attrSlice, f.Attrs)
+	}
+
+	if !bundling { // Write out JSON file with attributes
+		enc := json.NewEncoder(fha)
+		err = enc.Encode(&attrSlice)
+	}
+	return
+}
+
+// Call the script on a staged file
+func runScript(uuid, outputDat, outputAttrs string) {
+	log.Println("  Calling script", *scriptShell, *script, outputDat, outputAttrs)
+	output, err := exec.Command(*scriptShell, *script, outputDat, outputAttrs).Output()
+	if *verbose {
+		log.Println("----- START", *script, uuid, "-----")
+		fmt.Println(string(output))
+		log.Println("----- END", *script, uuid, "-----")
+		if err != nil {
+			log.Printf("error %s", err)
+		}
+	}
+
+	if *remove {
+		os.Remove(outputDat)
+		os.Remove(outputAttrs)
+		//if *verbose {
+		log.Printf("  Removed %s\n", uuid)
+		//}
+	}
+}
+
+// A stagedBundle is the currently open bundle which incoming posts are
+// appended to until a rollover seals it.  While open, the .inprogress file
+// holds the attributes of the FlowFiles which have been acknowledged.
+type stagedBundle struct {
+	uuid   string
+	output string
+	fh     *os.File
+	attrs  []flowfile.Attributes
+	size   int64
+	opened time.Time
+}
+
+var (
+	bundling    bool
+	bundleLimit int64
+	openBundle  *stagedBundle
+	bundleLock  sync.Mutex
+)
+
+func bundle_init() {
+	if *bundleMaxSize != "" {
+		bs, err := bunit.ParseBytes(*bundleMaxSize)
+		if err != nil {
+			log.Fatal("Unable to parse bundle-max-size", err)
+		}
+		bundleLimit = bs.Int64()
+	}
+	bundling = bundleLimit > 0 || *bundleMaxCount > 0 || *bundleMaxAge > 0
+	if !bundling {
+		return
+	}
+	log.Printf("Bundling staged FlowFiles, max-size: %q max-count: %d max-age: %v\n",
+		*bundleMaxSize, *bundleMaxCount, *bundleMaxAge)
+
+	if *bundleMaxAge > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Second)
+				bundleLock.Lock()
+				if openBundle != nil && time.Now().Sub(openBundle.opened) >= *bundleMaxAge {
+					bundleSeal()
 				}
+				bundleLock.Unlock()
 			}
+		}()
+	}
+}
 
-			if *remove {
-				os.Remove(outputDat)
-				os.Remove(outputAttrs)
-				//if *verbose {
-				log.Printf("  Removed %s\n", uuid)
-				//}
+// bundleAppend copies a verified post onto the open bundle and makes sure it
+// is on disk before returning, so the sender only sees success once the data
+// is durable.
+func bundleAppend(incoming string, attrSlice []flowfile.Attributes) (err error) {
+	in, err := os.Open(incoming)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return
+	}
+
+	bundleLock.Lock()
+	defer bundleLock.Unlock()
+
+	// Keep bundles under the size limit when possible
+	if b := openBundle; b != nil && bundleLimit > 0 && b.size > 0 && b.size+st.Size() > bundleLimit {
+		bundleSeal()
+	}
+
+	if openBundle == nil {
+		id := uuid.New().String()
+		b := &stagedBundle{uuid: id, output: path.Join(*basePath, id), opened: time.Now()}
+		if b.fh, err = os.OpenFile(b.output+".dat", os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644); err != nil {
+			return
+		}
+		if err = syncDir(*basePath); err != nil {
+			b.fh.Close()
+			os.Remove(b.output + ".dat")
+			return
+		}
+		openBundle = b
+		if *verbose {
+			log.Println("  Opened bundle", id)
+		}
+	}
+	b := openBundle
+
+	// Append the post, rolling back anything partially written on failure
+	var n int64
+	if n, err = io.Copy(b.fh, in); err == nil {
+		err = b.fh.Sync()
+	}
+	if err == nil {
+		attrs := append(b.attrs, attrSlice...)
+		if err = writeAcked(b.output, attrs); err == nil {
+			b.attrs, b.size = attrs, b.size+n
+		}
+	}
+	if err != nil {
+		b.fh.Truncate(b.size)
+		return
+	}
+
+	if (bundleLimit > 0 && b.size >= bundleLimit) || (*bundleMaxCount > 0 && len(b.attrs) >= *bundleMaxCount) {
+		bundleSeal()
+	}
+	return
+}
+
+// writeAcked records the attributes of the acknowledged FlowFiles of the open
+// bundle, replacing the previous record atomically.
+func writeAcked(output string, attrs []flowfile.Attributes) error {
+	fh, err := os.Create(output + ".acking")
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(fh).Encode(&attrs); err == nil {
+		err = fh.Sync()
+	}
+	fh.Close()
+	if err == nil {
+		err = os.Rename(output+".acking", output+".inprogress")
+	}
+	return err
+}
+
+// bundleSeal closes the open bundle and commits it for unstaging.  Must be
+// called with the bundleLock held.
+func bundleSeal() {
+	b := openBundle
+	if b == nil {
+		return
+	}
+	openBundle = nil
+	b.fh.Close()
+	if len(b.attrs) == 0 {
+		os.Remove(b.output + ".dat")
+		os.Remove(b.output + ".inprogress")
+		return
+	}
+	if err := os.Rename(b.output+".inprogress", b.output+".json"); err != nil {
+		log.Println("  Failed sealing bundle", b.uuid, err)
+		return
+	}
+	if *fsync {
+		syncDir(*basePath)
+	}
+	log.Printf("  Sealed bundle %s with %d FlowFiles (%v)\n", b.uuid, len(b.attrs), bunit.NewBytes(b.size))
+	if *script != "" {
+		go runScript(b.uuid, b.output+".dat", b.output+".json")
+	}
+}
+
+// Sync a directory so renames and new entries survive a crash
+func syncDir(dir string) error {
+	dh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dh.Close()
+	return dh.Sync()
+}
+
+// recoverStaged looks for staged payloads which were never committed, such as
+// after a crash, rebuilding the attributes from the payload when it is intact
+// and otherwise moving it into the quarantine directory.
+func recoverStaged() {
+	dirEntries, err := os.ReadDir(*basePath)
+	if err != nil {
+		return
+	}
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".incoming") || strings.HasSuffix(name, ".acking") {
+			// Posts which were never acknowledged
+			os.Remove(path.Join(*basePath, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".dat") {
+			if strings.HasSuffix(name, ".inprogress") {
+				// Attributes without a payload cannot be recovered
+				base := strings.TrimSuffix(name, ".inprogress")
+				if _, err := os.Stat(path.Join(*basePath, base+".dat")); os.IsNotExist(err) {
+					os.Remove(path.Join(*basePath, name))
+				}
+			}
+			continue
+		}
+		output := path.Join(*basePath, strings.TrimSuffix(name, ".dat"))
+		if _, err := os.Stat(output + ".json"); err == nil {
+			continue // Committed
+		}
+		if _, err := os.Stat(output + ".sending"); err == nil {
+			continue // Committed and claimed by ff-unstager
+		}
+
+		log.Println("Recovering orphaned staged file", output+".dat")
+		attrSlice, offsets, err := scanStaged(output + ".dat")
+		if err != nil {
+			// A bundle may have a damaged tail which was never acknowledged, so
+			// keep what the sender was told was received.
+			var acked []flowfile.Attributes
+			if dat, rerr := os.ReadFile(output + ".inprogress"); rerr == nil && json.Unmarshal(dat, &acked) == nil &&
+				len(acked) > 0 && len(acked) <= len(offsets) {
+				if err = os.Truncate(output+".dat", offsets[len(acked)-1]); err == nil {
+					log.Println("  Truncated unacknowledged tail of", output+".dat")
+					attrSlice = acked
+				}
 			}
 		}
+		if err == nil && len(attrSlice) == 0 {
+			log.Println("  Removing empty staged file", output+".dat")
+			os.Remove(output + ".dat")
+			os.Remove(output + ".inprogress")
+			continue
+		}
+		if err == nil {
+			err = writeStagedAttrs(output, attrSlice)
+		}
+		if err != nil {
+			log.Println("  Quarantining", output+".dat", err)
+			os.MkdirAll(*quarantine, 0755)
+			os.Rename(output+".dat", path.Join(*quarantine, name))
+			os.Remove(output + ".inprogress")
+			continue
+		}
+		log.Println("  Recovered", len(attrSlice), "FlowFiles in", output+".dat")
+	}
+}
+
+// scanStaged reads through a staged payload verifying every FlowFile and
+// returning the attributes as they would have been recorded by post, along
+// with the offset of the end of each intact FlowFile.
+func scanStaged(datFile string) (attrSlice []flowfile.Attributes, offsets []int64, err error) {
+	var fh *os.File
+	if fh, err = os.Open(datFile); err != nil {
+		return
+	}
+	defer fh.Close()
 
+	// Read the FlowFiles back to back
+	var offset int64
+	s := flowfile.NewScanner(fullReader{bufio.NewReader(fh)})
+	for s.Scan() {
+		f := s.File()
+		if _, err = io.Copy(io.Discard, f); err != nil {
+			return
+		}
+		if err = f.Verify(); err != nil {
+			return
+		}
+		offset += int64(f.HeaderSize()) + f.Size
+		offsets = append(offsets, offset)
 		f.Attrs.Set("size", fmt.Sprintf("%d", f.Size))
 		attrSlice = append(attrSlice, f.Attrs)
 	}
+	err = s.Err()
+	return
+}
 
-	{ // Write out JSON file with attributes
-		enc := json.NewEncoder(fha)
-		err = enc.Encode(&attrSlice)
+// writeStagedAttrs writes the attributes JSON and commits it into place
+func writeStagedAttrs(output string, attrSlice []flowfile.Attributes) error {
+	fha, err := os.Create(output + ".inprogress")
+	if err != nil {
+		return err
 	}
-	return
+	if err = json.NewEncoder(fha).Encode(&attrSlice); err == nil && *fsync {
+		err = fha.Sync()
+	}
+	fha.Close()
+	if err == nil {
+		err = os.Rename(output+".inprogress", output+".json")
+	}
+	if err == nil && *fsync {
+		err = syncDir(*basePath)
+	}
+	return err
 }
@@ -32,6 +32,7 @@ an action field with "UDP-TO-HTTP" value.`
 	mtu        = flag.Int("mtu", 1500, "MTU payload size for pre-allocating memory")
 	udpBufSize = flag.String("udp-buf", "100kB", "Set read buffer size, note: this is multiplied by the number of listening ports in memory usage")
 	noChecksum = flag.Bool("no-checksums", false, "Ignore doing checksum checks")
+	acceptV1   = flag.Bool("udp-accept-v1", true, "Accept version 1 packets, without a CRC, from senders not yet updated")
 	hs         *flowfile.HTTPTransaction
 
 	dst            *net.UDPAddr
@@ -113,8 +114,16 @@ type workUnit struct {
 
 	total int
 	noBuf bool
+
+	// Recent chunks are kept for rebuilding lost ones from the parity
+	ring    []byte
+	ringIdx []int
+	parity  map[int][][]byte
 }
 
+// Parity is kept for at most this many blocks which could not be rebuilt yet
+const fecMaxBlocks = 1024
+
 var workChan = make(chan *workUnit, 10000)
 
 // Worker unit for sending files
@@ -237,14 +246,16 @@ func handle(conn *net.UDPConn) {
 		}*/
 
 		// Parse the incoming packet's header for position and UUID info
-		var hdr ffHeader
-		binary.Read(bytes.NewReader(dat), binary.BigEndian, &hdr)
-		if n < int(ffHeaderSize) || hdr.MTU < 100 { // Invalid packet
+		hdr, version, flags, payload, perr := parseHeader(dat[:n], *acceptV1)
+		if perr != nil { // Invalid packet
+			if *debug {
+				fmt.Println("Dropped packet from", addr, perr)
+			}
 			continue
 		}
 
-		// If we have a new UUID
-		if !bytes.Equal(hdr.UUID[:], UUID[:]) {
+		// If we have a new UUID, or the first one is all zeros
+		if !bytes.Equal(hdr.UUID[:], UUID[:]) || job == nil && !done {
 			if job != nil {
 				job.wab.Reset(nil)
 				fmt.Println("  Could not reconstruct UUID:", UUID)
@@ -330,51 +341,151 @@ func handle(conn *net.UDPConn) {
 		}
 
 		// The current file is done, do nothing
-		if done || n == int(ffHeaderSize) { // short circuit for we are done
+		if done || len(payload) == 0 { // short circuit for we are done
 			continue
 		}
 
-		// Determine the offset
+		// Determine the offset, version 1 parity is only known by being past the
+		// payload
 		idx := int(hdr.Offset+1) / int(hdr.MTU)
-		if idx < job.total {
-			if job.seenChunks[idx] == 1 { // Duplicate packet, ignore
+		if flags&ffFlagParity != 0 || version == 1 && idx >= job.total {
+			if idx < job.total || len(payload) != fecHeaderSize+int(hdr.MTU) {
 				continue
 			}
-			job.seenChunks[idx] = 1
-
-			// Send to WriteAt
-			if !job.noBuf {
-				// Try the buffered WriteAt first
-				if _, err = job.wab.WriteAt(dat[ffHeaderSize:n], int64(hdr.Offset)); err != nil {
-					// Something bad happened, so flush it to disk and write all
-					job.fh.Truncate(int64(hdr.Size)) // Build out the file to the right size
-					job.wab.FlushAll()               // Wright all we have to disk
-					job.fh.Truncate(int64(hdr.Size)) // Ensure we are at the right size
-					job.noBuf = true                 // Prevent any further use of this buffer
-				}
+			job.rebuild(idx-job.total, payload)
+		} else if idx < job.total && len(payload) <= int(hdr.MTU) {
+			if job.seenChunks[idx] == 1 { // Duplicate packet, ignore
+				continue
 			}
-			if job.noBuf { // Write without buffering
-				//if *debug {
-				//	fmt.Println("fall back to nobuf")
-				//}
-				job.fh.WriteAt(dat[ffHeaderSize:n], int64(hdr.Offset))
+			job.store(idx, payload)
+		} else {
+			continue
+		}
+
+		done = true
+		for _, ck := range job.seenChunks {
+			if ck == 0 {
+				done = false
+				break
 			}
+		}
+		if done {
+			//if *verbose {
+			//	fmt.Printf("sending job %v\n", job.hdr)
+			//}
+			metrics.MetricsThreadsQueued++
+			workChan <- job
+			job = nil
+		}
+	}
+}
 
-			done = true
-			for _, ck := range job.seenChunks {
-				if ck == 0 {
-					done = false
-					break
-				}
+// store writes out a chunk and keeps a copy for rebuilding others
+func (job *workUnit) store(idx int, p []byte) {
+	job.seenChunks[idx] = 1
+	offset := int64(idx) * int64(job.hdr.MTU)
+
+	// Send to WriteAt
+	if !job.noBuf {
+		// Try the buffered WriteAt first
+		if _, err := job.wab.WriteAt(p, offset); err != nil {
+			// Something bad happened, so flush it to disk and write all
+			job.fh.Truncate(int64(job.hdr.Size)) // Build out the file to the right size
+			job.wab.FlushAll()                   // Wright all we have to disk
+			job.fh.Truncate(int64(job.hdr.Size)) // Ensure we are at the right size
+			job.noBuf = true                     // Prevent any further use of this buffer
+		}
+	}
+	if job.noBuf { // Write without buffering
+		job.fh.WriteAt(p, offset)
+	}
+
+	mtu := int(job.hdr.MTU)
+	if job.ring == nil {
+		job.ring = make([]byte, fecRingChunks*mtu)
+		job.ringIdx = make([]int, fecRingChunks)
+		for i := range job.ringIdx {
+			job.ringIdx[i] = -1
+		}
+	}
+	slot := idx % fecRingChunks
+	chunk := job.ring[slot*mtu : (slot+1)*mtu]
+	for i := copy(chunk, p); i < mtu; i++ {
+		chunk[i] = 0
+	}
+	job.ringIdx[slot] = idx
+}
+
+// rebuild takes in parity packet j and when enough of its block is here,
+// rebuilds the missing chunks
+func (job *workUnit) rebuild(j int, p []byte) {
+	var fh fecHeader
+	binary.Read(bytes.NewReader(p), binary.BigEndian, &fh)
+	data, parity, depth := int(fh.Data), int(fh.Parity), int(fh.Depth)
+	if data == 0 || parity == 0 || data+parity > 256 || depth == 0 || data*depth > fecRingChunks/2 {
+		return
+	}
+
+	block, mtu := j/parity, int(job.hdr.MTU)
+	if fecChunk(block, 0, data, depth) >= job.total {
+		return
+	}
+	index := func(k int) int { return fecChunk(block, k, data, depth) }
+
+	// Nothing to do when the whole block is here
+	missing := 0
+	for k := 0; k < data && index(k) < job.total; k++ {
+		if job.seenChunks[index(k)] == 0 {
+			missing++
+		}
+	}
+	if missing == 0 {
+		delete(job.parity, block)
+		return
+	}
+
+	if job.parity == nil {
+		job.parity = make(map[int][][]byte)
+	}
+	ps := job.parity[block]
+	if len(ps) != parity {
+		if len(job.parity) >= fecMaxBlocks {
+			for b := range job.parity {
+				delete(job.parity, b) // Give up on a block to bound the memory
+				break
 			}
-			if done {
-				//if *verbose {
-				//	fmt.Printf("sending job %v\n", job.hdr)
-				//}
-				metrics.MetricsThreadsQueued++
-				workChan <- job
-				job = nil
+		}
+		ps = make([][]byte, parity)
+		job.parity[block] = ps
+	}
+	if ps[j%parity] == nil {
+		ps[j%parity] = append([]byte{}, p[fecHeaderSize:]...)
+	}
+
+	// Rebuild from the chunks still in the ring
+	shards, err := fecRebuild(data, parity, depth, block, job.total, mtu, func(i int) []byte {
+		if slot := i % fecRingChunks; job.seenChunks[i] == 1 && job.ringIdx != nil && job.ringIdx[slot] == i {
+			return job.ring[slot*mtu : (slot+1)*mtu]
+		}
+		return nil
+	}, ps)
+	if err != nil && *debug {
+		log.Println("Unable to rebuild block", block, err)
+	}
+	if shards == nil {
+		return
+	}
+	for k := 0; k < data; k++ {
+		if i := index(k); i < job.total && job.seenChunks[i] == 0 {
+			size := mtu
+			if last := int(job.hdr.Size) - i*mtu; last < size {
+				size = last
 			}
+			job.store(i, shards[k][:size])
 		}
 	}
+	delete(job.parity, block)
+	if *verbose {
+		log.Println("Rebuilt", missing, "chunks of block", block, "from parity")
+	}
 }
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"main/filelock"
+
 	"github.com/pschou/go-flowfile"
+	"github.com/remeh/sizedwaitgroup"
 )
 
 var about = `FF-Unstager
@@ -23,20 +31,66 @@ headers.`
 
 var (
 	basePath = flag.String("path", "stager", "Directory which to scan for FlowFiles")
+	threads  = flag.Int("threads", 1, "Number of staged files to send in parallel")
+
+	deadLetter      = flag.String("dead-letter", "", "Directory in which to move staged files which failed to send (default is path/dead-letter)")
+	requeue         = flag.Bool("requeue", false, "Move the files in the dead-letter directory back into the staging path on startup")
+	retryMaxTimeout = flag.Duration("retry-max-timeout", 10*time.Minute, "Maximum time between retries, the retry-timeout doubles after every failure")
+	postCount       = flag.Int("post-count", 100, "Maximum number of FlowFiles in one HTTP post, a retry resumes after the last acknowledged post\n"+
+		"To send the whole staged file in one post use -post-count=0, a retry then resends all of it")
+	perFile = flag.Bool("per-file", false, "Send each FlowFile in its own HTTP post instead of buffering the staged file into one post")
+
+	order        = flag.String("order", "fifo", "Order in which staged files are sent: \"fifo\" or \"lifo\" by stage time, or \"priority\"")
+	priorityAttr = flag.String("priority-attribute", "priority", "Attribute holding the priority of a FlowFile, lower numbers are sent first\n"+
+		"A staged file takes on the most urgent priority of the FlowFiles in it, and those without one are sent last.")
+	priorityLimits = flag.String("priority-limits", "", "Maximum number of concurrent sends for a priority when ordering by priority\n"+
+		"Example: -priority-limits=\"1=4,5=1,none=1\"")
 )
 
-var hs *flowfile.HTTPTransaction
+var (
+	hs      *flowfile.HTTPTransaction
+	metrics = flowfile.NewMetrics()
+	mlock   sync.Mutex
+
+	// Concurrent sends by priority, along with the configured limits
+	inFlight      = make(map[string]int)
+	limits        = make(map[string]int)
+	priorityCache = make(map[string]stagedPriority) // Cached by staged file
+)
 
 func main() {
 	service_flags()
 	origin_flags()
 	sender_flags()
+	metrics_flags(false)
 	parse()
 
 	if len(flag.Args()) != 0 {
 		flag.Usage()
 		return
 	}
+	if *deadLetter == "" {
+		*deadLetter = path.Join(*basePath, "dead-letter")
+	}
+	if *requeue {
+		requeueDeadLetters()
+	}
+	switch *order {
+	case "fifo", "lifo", "priority":
+	default:
+		log.Fatalf("Unknown order %q", *order)
+	}
+	for _, kv := range strings.Split(*priorityLimits, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		n, err := strconv.Atoi(strings.TrimSpace(parts[len(parts)-1]))
+		if len(parts) != 2 || err != nil || n < 1 {
+			log.Fatalf("Invalid priority limit %q", kv)
+		}
+		limits[strings.TrimSpace(parts[0])] = n
+	}
 
 	log.Println("Creating sender,", *url)
 
@@ -46,106 +100,428 @@ func main() {
 		log.Fatal(err)
 	}
 
-	log.Println("Creating directory listener on", *basePath)
+	metricsGauges["flowfiles_unstager_queue_depth"] = func() int64 { return countFiles(*basePath, ".json", ".sending") }
+	metricsGauges["flowfiles_unstager_dead_letters"] = func() int64 { return countFiles(*deadLetter, ".json") }
+	send_metrics("UNSTAGER", func(f *flowfile.File) { hs.Send(f) }, metrics)
+
+	log.Println("Creating directory listener on", *basePath, "with", *threads, "thread(s)")
+	swg := sizedwaitgroup.New(*threads)
 
 	// infinite loop for scanning the directory
-	for ; true; time.Sleep(3 * time.Second) {
+	for {
 		dirEntries, err := os.ReadDir(*basePath)
 		if err != nil {
 			log.Println("Error listing files:", err)
+			time.Sleep(3 * time.Second)
 			continue
 		}
 
+		// Loop over the files in the directory looking for .json files, or
+		// .sending files left behind by a sender which is no longer running
+		var queue []*stagedEntry
 		for _, entry := range dirEntries {
-			// Loop over the files in the directory looking for .json files
-			jsonFile := path.Join(*basePath, entry.Name())
-			if !strings.HasSuffix(jsonFile, ".json") {
+			name := entry.Name()
+			if !strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ".sending") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
 				continue
 			}
-			datFile := strings.TrimSuffix(jsonFile, ".json") + ".dat"
+			queue = append(queue, &stagedEntry{
+				base:   path.Join(*basePath, strings.TrimSuffix(strings.TrimSuffix(name, ".json"), ".sending")),
+				fresh:  strings.HasSuffix(name, ".json"),
+				staged: info.ModTime(),
+			})
+		}
+		orderStaged(queue)
 
-			processFile := func() (err error) { // Break out the thread
-				var f *flowfile.File
-				var fh *os.File
+		// Only hand out as many as there are threads before looking again, so
+		// newly staged files are put in their place in the order
+		var claimed int
+		for _, e := range queue {
+			if claimed >= *threads {
+				break
+			}
+			level := e.priority.level
+			mlock.Lock()
+			if limit, ok := limits[level]; ok && inFlight[level] >= limit {
+				mlock.Unlock()
+				continue
+			}
+			mlock.Unlock()
 
-				// Open the file
-				if fh, err = os.Open(datFile); err != nil {
-					err = fmt.Errorf("Error opening staged file:", err)
-					return
-				}
+			swg.Add()
+			fh := claimStaged(e.base, e.fresh)
+			if fh == nil {
+				swg.Done()
+				continue
+			}
+			claimed++
+			mlock.Lock()
+			inFlight[level]++
+			metrics.MetricsThreadsActive++
+			mlock.Unlock()
+			go func(base string) {
+				defer swg.Done()
+				defer fh.Close()
+				sendStaged(base, fh)
+				mlock.Lock()
+				inFlight[level]--
+				metrics.MetricsThreadsActive--
+				metrics.MetricsThreadsTerminated++
+				mlock.Unlock()
+			}(e.base)
+		}
+		if claimed == 0 {
+			time.Sleep(3 * time.Second)
+		}
+	}
+}
+
+// A stagedEntry is a staged file waiting to be sent
+type stagedEntry struct {
+	base     string
+	fresh    bool // Not yet claimed by anyone
+	staged   time.Time
+	priority stagedPriority
+}
+
+type stagedPriority struct {
+	staged time.Time
+	rank   int64
+	level  string
+}
+
+// orderStaged sorts the staged files into the order in which to send them
+func orderStaged(queue []*stagedEntry) {
+	switch *order {
+	case "fifo":
+		sort.SliceStable(queue, func(i, j int) bool { return queue[i].staged.Before(queue[j].staged) })
+	case "lifo":
+		sort.SliceStable(queue, func(i, j int) bool { return queue[i].staged.After(queue[j].staged) })
+	case "priority":
+		seen := make(map[string]bool)
+		for _, e := range queue {
+			e.priority = readPriority(e)
+			seen[e.base] = true
+		}
+		// Drop the cache for files which are gone
+		for base := range priorityCache {
+			if !seen[base] {
+				delete(priorityCache, base)
+			}
+		}
+		sort.SliceStable(queue, func(i, j int) bool {
+			if queue[i].priority.rank != queue[j].priority.rank {
+				return queue[i].priority.rank < queue[j].priority.rank
+			}
+			return queue[i].staged.Before(queue[j].staged)
+		})
+	}
+}
+
+// readPriority finds the most urgent priority among the FlowFiles of a staged
+// file from the attributes recorded at staging, the payload is not read.
+func readPriority(e *stagedEntry) stagedPriority {
+	if p, ok := priorityCache[e.base]; ok && p.staged.Equal(e.staged) {
+		return p
+	}
+	p := stagedPriority{staged: e.staged, rank: math.MaxInt64, level: "none"}
+	metaFile := e.base + ".json"
+	if !e.fresh {
+		metaFile = e.base + ".sending"
+	}
+	var attrSlice []flowfile.Attributes
+	if dat, err := os.ReadFile(metaFile); err != nil {
+		return p // Likely claimed in the meantime, try again next time
+	} else if err = json.Unmarshal(dat, &attrSlice); err != nil {
+		log.Println("Unable to read priority from", metaFile, err)
+	}
+	for _, attrs := range attrSlice {
+		val := strings.TrimSpace(attrs.Get(*priorityAttr))
+		if rank, err := strconv.ParseInt(val, 10, 64); err == nil && rank < p.rank {
+			p.rank, p.level = rank, val
+		}
+	}
+	priorityCache[e.base] = p
+	return p
+}
+
+// claimStaged takes ownership of a staged bundle so that several threads, or
+// several ff-unstager processes, can share one staging directory.  The .json
+// is renamed to .sending and the .dat is held with an exclusive lock for as
+// long as it is being sent.  A .sending file whose .dat is not locked was left
+// behind by a sender which has gone away and is claimed again.
+func claimStaged(base string, fresh bool) *os.File {
+	if fresh {
+		if err := os.Rename(base+".json", base+".sending"); err != nil {
+			return nil // Claimed by someone else
+		}
+	}
+	fh, err := os.Open(base + ".dat")
+	if err != nil {
+		return nil
+	}
+	if err = filelock.TryLock(fh); err != nil {
+		fh.Close()
+		return nil // Being sent by someone else
+	}
+
+	// Make sure the bundle was not finished while we were waiting on the lock
+	if _, err = os.Stat(base + ".sending"); err != nil {
+		fh.Close()
+		return nil
+	}
+	if !fresh {
+		log.Println("Reclaiming abandoned staged file", base+".dat")
+	}
+	return fh
+}
+
+// sendStaged sends out all the FlowFiles in a claimed bundle, retrying with an
+// increasing delay before giving up and moving it to the dead-letter directory.
+func sendStaged(base string, fh *os.File) {
+	datFile, sendingFile, progressFile := base+".dat", base+".sending", base+".progress"
+	processFile := func() (err error) { // Break out the thread
+		var f *flowfile.File
+
+		// Pick up after the last FlowFile which was acknowledged
+		var p stagedProgress
+		if dat, rerr := os.ReadFile(progressFile); rerr == nil && json.Unmarshal(dat, &p) == nil && p.Sent > 0 {
+			log.Println("Resuming", datFile, "after", p.Sent, "FlowFiles")
+		} else {
+			p = stagedProgress{}
+		}
+		if *verbose {
+			log.Println("Sending staged file", datFile)
+		}
+		if _, err = fh.Seek(p.Offset, io.SeekStart); err != nil {
+			return
+		}
+
+		var hw *flowfile.HTTPPostWriter
+		var inPost []int64
+		offset := p.Offset
+
+		// Close out the current post and record the progress once acknowledged
+		commit := func() error {
+			if hw == nil {
+				return nil
+			}
+			err := hw.Close()
+			res := hw.Response
+			hw = nil
+			if err != nil {
+				return err
+			}
+			if res == nil {
+				return fmt.Errorf("FlowFiles did not send successfully")
+			} else if res.StatusCode != 200 {
+				return fmt.Errorf("FlowFiles did not send successfully, code %d", res.StatusCode)
+			}
+			mlock.Lock()
+			for _, size := range inPost {
+				metrics.BucketCounter(size)
+			}
+			mlock.Unlock()
+			p.Sent, p.Offset, inPost = p.Sent+len(inPost), offset, inPost[:0]
+			return writeProgress(progressFile, p)
+		}
+
+		defer func() {
+			if hw != nil {
+				// Abort the post so the receiver does not keep a partial bundle
+				hw.Terminate()
+				hw.Close()
+			}
+			if *verbose && err != nil {
+				log.Println("err:", err)
+			}
+			if err == nil {
+				// Success!  Remove all the artifacts (clean things up)
+				os.Remove(sendingFile)
+				os.Remove(progressFile)
+				os.Remove(datFile)
+			}
+		}()
+
+		// Read in the FlowFiles, a bundle may hold several back to back
+		s := flowfile.NewScanner(fullReader{bufio.NewReader(fh)})
+		for s.Scan() {
+			f = s.File()
+
+			// Where this FlowFile ends in the staged file, taken before the
+			// attributes are changed
+			end := offset + int64(f.HeaderSize()) + f.Size
+
+			// Make sure the client chain is added to attributes, 1 being the closest
+			updateChain(f, nil, "FROM-DISK")
+
+			// Quick sanity check that paths are not in a bad state
+			dir := filepath.Clean(f.Attrs.Get("path"))
+			filename := f.Attrs.Get("filename")
+			if strings.HasPrefix(dir, "..") {
+				err = fmt.Errorf("Invalid path %q", dir)
+				return
+			}
+
+			if id := f.Attrs.Get("fragment.index"); id != "" {
+				i, _ := strconv.Atoi(id)
+				fmt.Printf("  Unstaging segment %d of %s of %s\n", i+1,
+					f.Attrs.Get("fragment.count"), path.Join(dir, filename))
+			} else {
+				fmt.Printf("  Unstaging file %s\n", path.Join(dir, filename))
+			}
+
+			if *verbose {
+				adat, _ := json.Marshal(f.Attrs)
+				fmt.Printf("    %s\n", adat)
+			}
 
-				hw := hs.NewHTTPBufferedPostWriter()
-				defer func() {
-					fh.Close()
-					if *verbose && err != nil {
-						log.Println("err:", err)
-					}
-					if err == nil {
-						// Success!  Remove all the artifacts (clean things up)
-						os.Remove(jsonFile)
-						os.Remove(datFile)
-					}
-				}()
-
-				// Read in the FlowFile
-				s := flowfile.NewScanner(fh)
-				for s.Scan() {
-					f = s.File()
-
-					// Make sure the client chain is added to attributes, 1 being the closest
-					updateChain(f, nil, "FROM-DISK")
-
-					// Quick sanity check that paths are not in a bad state
-					dir := filepath.Clean(f.Attrs.Get("path"))
-					filename := f.Attrs.Get("filename")
-					if strings.HasPrefix(dir, "..") {
-						err = fmt.Errorf("Invalid path %q", dir)
-						return
-					}
-
-					if id := f.Attrs.Get("fragment.index"); id != "" {
-						i, _ := strconv.Atoi(id)
-						fmt.Printf("  Unstaging segment %d of %s of %s\n", i+1,
-							f.Attrs.Get("fragment.count"), path.Join(dir, filename))
-					} else {
-						fmt.Printf("  Unstaging file %s\n", path.Join(dir, filename))
-					}
-
-					if *verbose {
-						adat, _ := json.Marshal(f.Attrs)
-						fmt.Printf("    %s\n", adat)
-					}
-
-					if _, err = hw.Write(f); err != nil {
-						return
-					}
+			if *perFile {
+				if err = hs.Send(f); err != nil {
+					return
 				}
-				if hwerr := hw.Close(); err == nil {
-					err = hwerr
+				offset = end
+				mlock.Lock()
+				metrics.BucketCounter(f.Size)
+				mlock.Unlock()
+				p.Sent, p.Offset = p.Sent+1, offset
+				if err = writeProgress(progressFile, p); err != nil {
+					return
 				}
+				continue
+			}
 
-				if scanErr := s.Err(); scanErr != nil {
-					log.Println("Error reading file from disk:", scanErr)
-				}
+			if hw == nil {
+				hw = hs.NewHTTPBufferedPostWriter()
+			}
+			if _, err = hw.Write(f); err != nil {
 				return
 			}
-
-			err = processFile()
-			fmt.Println("processFile", err)
-
-			// Try a few more times before we give up
-			for i := 1; err != nil && i < *retries; i++ {
-				log.Println(i, "Error sending:", err)
-				time.Sleep(*retryTimeout)
-				if hserr := hs.Handshake(); hserr == nil {
-					err = processFile()
+			offset = end
+			inPost = append(inPost, f.Size)
+			if *postCount > 0 && len(inPost) >= *postCount {
+				if err = commit(); err != nil {
+					return
 				}
 			}
+		}
+		if err = s.Err(); err != nil {
+			return fmt.Errorf("Error reading file from disk: %s", err)
+		}
+		return commit()
+	}
 
-			if err != nil {
-				log.Fatal(err)
+	err := processFile()
+
+	// Try a few more times before we give up, backing off after each failure
+	wait := *retryTimeout
+	for i := 1; err != nil && i < *retries; i++ {
+		log.Println(i, "Error sending", datFile, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > *retryMaxTimeout {
+			wait = *retryMaxTimeout
+		}
+		if hserr := hs.Handshake(); hserr == nil {
+			err = processFile()
+		} else {
+			err = hserr
+		}
+	}
+
+	if err != nil {
+		moveDeadLetter(base, err)
+	}
+}
+
+// stagedProgress records how far into a staged file the FlowFiles have been
+// acknowledged by the receiver.
+type stagedProgress struct {
+	Sent   int   `json:"sent"`
+	Offset int64 `json:"offset"`
+}
+
+// writeProgress records the progress, written to a temporary file and moved
+// into place so a crash never leaves a partial record.
+func writeProgress(progressFile string, p stagedProgress) error {
+	dat, _ := json.Marshal(p)
+	if err := os.WriteFile(progressFile+".tmp", dat, 0644); err != nil {
+		return err
+	}
+	return os.Rename(progressFile+".tmp", progressFile)
+}
+
+// moveDeadLetter sets aside a bundle which could not be sent, recording the
+// error beside it, so the remaining bundles continue to drain.
+func moveDeadLetter(base string, sendErr error) {
+	name := path.Base(base)
+	dead := path.Join(*deadLetter, name)
+	log.Println("Moving", base+".dat", "to dead-letter directory", *deadLetter, "after error:", sendErr)
+
+	err := os.MkdirAll(*deadLetter, 0755)
+	if err == nil {
+		err = os.WriteFile(dead+".error", []byte(fmt.Sprintf("%s %s\n",
+			time.Now().Format(time.RFC3339), sendErr)), 0644)
+	}
+	if err == nil {
+		err = os.Rename(base+".dat", dead+".dat")
+	}
+	if err == nil {
+		if err = os.Rename(base+".progress", dead+".progress"); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(base+".sending", dead+".json")
+	}
+	if err != nil {
+		// Release the claim so the bundle is picked up again on restart
+		os.Rename(base+".sending", base+".json")
+		log.Fatal("Unable to move to dead-letter directory: ", err)
+	}
+}
+
+// requeueDeadLetters moves all the dead letters back into the staging path,
+// the .dat is moved ahead of the .json so a bundle is never seen half way.
+func requeueDeadLetters() {
+	dirEntries, err := os.ReadDir(*deadLetter)
+	if err != nil {
+		return
+	}
+	var n int
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		dead, base := path.Join(*deadLetter, name), path.Join(*basePath, name)
+		if err = os.Rename(dead+".dat", base+".dat"); err == nil {
+			// Keep the progress so the sending resumes where it had stopped
+			os.Rename(dead+".progress", base+".progress")
+			err = os.Rename(dead+".json", base+".json")
+		}
+		if err != nil {
+			log.Println("Unable to requeue", dead+".dat", err)
+			continue
+		}
+		os.Remove(dead + ".error")
+		n++
+	}
+	log.Println("Requeued", n, "staged files from", *deadLetter)
+}
+
+// countFiles counts the files in a directory with any of the given suffixes
+func countFiles(dir string, suffixes ...string) (n int64) {
+	dirEntries, _ := os.ReadDir(dir)
+	for _, entry := range dirEntries {
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(entry.Name(), suffix) {
+				n++
+				break
 			}
 		}
 	}
-	log.Println("done.")
+	return
 }
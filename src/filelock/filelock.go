@@ -0,0 +1,15 @@
+//go:build !windows
+
+// Package filelock takes exclusive locks on open files, which the operating
+// system drops when the file is closed or the process goes away.
+package filelock
+
+import (
+	"os"
+	"syscall"
+)
+
+// TryLock takes an exclusive lock on an open file without waiting
+func TryLock(fh *os.File) error {
+	return syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
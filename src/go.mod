@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/docker/go-units v0.5.0
 	github.com/google/uuid v1.3.0
+	github.com/klauspost/reedsolomon v1.11.7
 	github.com/mdlayher/watchdog v0.0.0-20221003142519-49be0df7b3b5
 	github.com/pschou/go-bunit v0.0.0-20230227134742-7f9fa377cf74
 	github.com/pschou/go-flowfile v0.0.0-20230301020414-6ecc1a33f18b
@@ -23,12 +24,11 @@ require (
 	github.com/cymertek/go-big v0.0.0-20221028234842-57aba6a92118 // indirect
 	github.com/djherbis/times v1.5.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.1.1 // indirect
-	github.com/klauspost/reedsolomon v1.11.7 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pschou/go-sorting/numstr v0.0.0-20230218015952-a2a98f172ba3 // indirect
 	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
 	github.com/templexxx/xor v0.0.0-20191217153810-f85b25db303b // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
 	golang.org/x/net v0.6.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
+	golang.org/x/sys v0.5.0
 )
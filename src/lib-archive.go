@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pschou/go-bunit"
+)
+
+var (
+	extract           = new(bool)
+	extractMaxSize    = new(string)
+	extractMaxEntries = new(int)
+	extractRemove     = new(bool)
+
+	ErrArchiveLimit = errors.New("Archive exceeds size or entry limits")
+)
+
+func extract_flags() {
+	extract = flag.Bool("extract", false, "Extract verified tar, tar.gz and zip archives into a sibling directory")
+	extractMaxSize = flag.String("extract-max-size", "10GB", "Maximum total uncompressed size allowed when extracting an archive")
+	extractMaxEntries = flag.Int("extract-max-entries", 100000, "Maximum number of entries allowed when extracting an archive")
+	extractRemove = flag.Bool("extract-rm", false, "Remove the archive after it has been successfully extracted")
+}
+
+// An archiveMember describes one entry read out of an archive.
+type archiveMember struct {
+	Name    string
+	Dir     bool
+	Symlink bool
+	Link    string // Symlink target
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// archiveLimits guards against decompression bombs by counting the entries
+// and the actual bytes read out of an archive, never trusting the headers.
+type archiveLimits struct {
+	maxBytes   int64
+	maxEntries int
+	bytes      int64
+	entries    int
+}
+
+func (l *archiveLimits) Read(r io.Reader) io.Reader {
+	return &limitReader{r: r, l: l}
+}
+
+type limitReader struct {
+	r io.Reader
+	l *archiveLimits
+}
+
+func (lr *limitReader) Read(p []byte) (n int, err error) {
+	n, err = lr.r.Read(p)
+	lr.l.bytes += int64(n)
+	if lr.l.maxBytes > 0 && lr.l.bytes > lr.l.maxBytes {
+		return n, ErrArchiveLimit
+	}
+	return
+}
+
+// archiveType determines the archive kind by the file name, the content is
+// later confirmed by the magic bytes when opened.
+func archiveType(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	}
+	return ""
+}
+
+// archiveTrim removes the archive extension from a file name
+func archiveTrim(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+// archiveWalk calls fn for every member of an archive with a reader for the
+// member's content.
+func archiveWalk(kind string, ra io.ReaderAt, size int64, lim *archiveLimits,
+	fn func(m *archiveMember, r io.Reader) error) (err error) {
+	head := make([]byte, 512)
+	n, _ := ra.ReadAt(head, 0)
+	head = head[:n]
+
+	switch kind {
+	case "zip":
+		if !bytes.HasPrefix(head, []byte("PK\x03\x04")) && !bytes.HasPrefix(head, []byte("PK\x05\x06")) {
+			return fmt.Errorf("Not a zip archive")
+		}
+		var zr *zip.Reader
+		if zr, err = zip.NewReader(ra, size); err != nil {
+			return
+		}
+		for _, zf := range zr.File {
+			if lim.entries++; lim.maxEntries > 0 && lim.entries > lim.maxEntries {
+				return ErrArchiveLimit
+			}
+			if zf.Flags&0x1 != 0 {
+				return fmt.Errorf("Encrypted archive member %q", zf.Name)
+			}
+			m := &archiveMember{Name: zf.Name, Mode: zf.Mode(), ModTime: zf.Modified,
+				Size: int64(zf.UncompressedSize64), Dir: zf.Mode().IsDir()}
+			var rc io.ReadCloser
+			if rc, err = zf.Open(); err != nil {
+				return
+			}
+			if zf.Mode()&os.ModeSymlink != 0 {
+				// The target of a symlink is stored as the content
+				var target []byte
+				target, err = io.ReadAll(io.LimitReader(rc, 4096))
+				m.Symlink, m.Link = true, string(target)
+				if err == nil {
+					err = fn(m, bytes.NewReader(nil))
+				}
+			} else {
+				err = fn(m, lim.Read(rc))
+			}
+			rc.Close()
+			if err != nil {
+				return
+			}
+		}
+		return
+
+	case "tar.gz":
+		if !bytes.HasPrefix(head, []byte{0x1f, 0x8b}) {
+			return fmt.Errorf("Not a gzip archive")
+		}
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(io.NewSectionReader(ra, 0, size)); err != nil {
+			return
+		}
+		defer gz.Close()
+		return tarWalk(bufio.NewReader(gz), lim, fn)
+
+	case "tar":
+		if len(head) < 262 || string(head[257:262]) != "ustar" {
+			return fmt.Errorf("Not a tar archive")
+		}
+		return tarWalk(io.NewSectionReader(ra, 0, size), lim, fn)
+	}
+	return fmt.Errorf("Unknown archive type %q", kind)
+}
+
+func tarWalk(r io.Reader, lim *archiveLimits, fn func(m *archiveMember, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if lim.entries++; lim.maxEntries > 0 && lim.entries > lim.maxEntries {
+			return ErrArchiveLimit
+		}
+		m := &archiveMember{Name: hdr.Name, Size: hdr.Size, Mode: hdr.FileInfo().Mode(), ModTime: hdr.ModTime}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			m.Dir = true
+		case tar.TypeSymlink:
+			m.Symlink, m.Link = true, hdr.Linkname
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return fmt.Errorf("Unsupported archive member %q type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err = fn(m, lim.Read(tr)); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveName validates a member name, refusing absolute paths and anything
+// which would traverse out of the extraction directory.
+func archiveName(name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Unsafe path in archive %q", name)
+	}
+	return clean, nil
+}
+
+// extractArchive unpacks the archive at src into a directory named after the
+// archive (without the extension) beside fp, or <name>.N when that is already
+// taken, so nothing received before is ever replaced.  The archive is unpacked
+// into a temporary directory first so a refused archive never leaves partial
+// content.
+func extractArchive(src, fp string) (dest string, err error) {
+	kind := archiveType(fp)
+	if kind == "" {
+		return
+	}
+	lim := &archiveLimits{maxEntries: *extractMaxEntries}
+	var bs bunit.Bytes
+	if bs, err = bunit.ParseBytes(*extractMaxSize); err != nil {
+		return
+	}
+	lim.maxBytes = bs.Int64()
+
+	var fh *os.File
+	if fh, err = os.Open(src); err != nil {
+		return
+	}
+	defer fh.Close()
+	var fi os.FileInfo
+	if fi, err = fh.Stat(); err != nil {
+		return
+	}
+
+	stem := archiveTrim(fp)
+	if base := filepath.Base(stem); base == "." || base == ".." || stem == "" || strings.HasSuffix(stem, "/") {
+		return "", fmt.Errorf("No name left for the extraction of %q", fp)
+	}
+	tmp := stem + ".extracting-" + randStringBytes(8)
+	if err = os.MkdirAll(tmp, 0755); err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	var list []string
+	err = archiveWalk(kind, fh, fi.Size(), lim, func(m *archiveMember, r io.Reader) (err error) {
+		var name string
+		if name, err = archiveName(m.Name); err != nil {
+			return
+		}
+		if name == "." {
+			if m.Dir {
+				return // The top directory is already in place
+			}
+			return fmt.Errorf("Unsafe path in archive %q", m.Name)
+		}
+		target := filepath.Join(tmp, name)
+
+		// Refuse to write through any symlink created earlier in the archive
+		for p := filepath.Dir(target); p != tmp && len(p) > len(tmp); p = filepath.Dir(p) {
+			if st, err := os.Lstat(p); err == nil && st.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("Archive member %q is beneath a symlink", m.Name)
+			}
+		}
+
+		switch {
+		case m.Dir:
+			err = os.MkdirAll(target, 0755)
+		case m.Symlink:
+			if filepath.IsAbs(m.Link) {
+				return fmt.Errorf("Absolute symlink %q -> %q in archive", m.Name, m.Link)
+			}
+			if _, err = archiveName(path.Join(path.Dir(name), m.Link)); err != nil {
+				return fmt.Errorf("Symlink %q -> %q escapes archive", m.Name, m.Link)
+			}
+			os.MkdirAll(filepath.Dir(target), 0755)
+			err = os.Symlink(m.Link, target)
+		default:
+			os.MkdirAll(filepath.Dir(target), 0755)
+			var out *os.File
+			if out, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, m.Mode.Perm()|0600); err != nil {
+				return
+			}
+			_, err = io.Copy(out, r)
+			out.Close()
+			if err == nil && !m.ModTime.IsZero() {
+				os.Chtimes(target, m.ModTime, m.ModTime)
+			}
+		}
+		if err == nil {
+			list = append(list, name)
+		}
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Move the extracted content into place beside anything already there
+	if dest, err = extractPlace(tmp, stem); err != nil {
+		return "", err
+	}
+	for _, name := range list {
+		log.Println("    Extracted", path.Join(dest, name))
+	}
+	log.Printf("  Extracted %d entries (%v) from %s to %s\n", len(list), bunit.NewBytes(lim.bytes), fp, dest)
+	return
+}
+
+// extractPlace moves the extracted directory to the stem or the first free
+// stem.N, a rename only lands on a name which does not exist yet.
+func extractPlace(tmp, stem string) (string, error) {
+	for i := 0; i < 1000; i++ {
+		dest := stem
+		if i > 0 {
+			dest = fmt.Sprintf("%s.%d", stem, i)
+		}
+		if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(tmp, dest); err == nil {
+			return dest, nil
+		} else if _, serr := os.Lstat(dest); os.IsNotExist(serr) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("No free name to extract to beside %q", stem)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntry is a member written into a test archive, a link makes it a symlink
+type testEntry struct {
+	name, body, link string
+	dir              bool
+}
+
+func testTar(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		switch {
+		case e.dir:
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0755, 0
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.body))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func testZip(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		fh.SetMode(0644)
+		if e.link != "" {
+			fh.SetMode(os.ModeSymlink | 0777)
+		}
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.link != "" {
+			w.Write([]byte(e.link))
+		} else {
+			w.Write([]byte(e.body))
+		}
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func testExtractSetup(t *testing.T) string {
+	t.Helper()
+	*extractMaxSize, *extractMaxEntries = "1MB", 100
+	return t.TempDir()
+}
+
+func TestExtractArchiveUnsafe(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		zip     bool
+		entries []testEntry
+	}{
+		{"parent traversal", "a.tar", false, []testEntry{{name: "../evil", body: "x"}}},
+		{"nested traversal", "a.tar", false, []testEntry{{name: "d/../../evil", body: "x"}}},
+		{"absolute path", "a.tar", false, []testEntry{{name: "/tmp/evil", body: "x"}}},
+		{"symlink escape", "a.tar", false, []testEntry{{name: "l", link: "../../evil"}}},
+		{"absolute symlink", "a.tar", false, []testEntry{{name: "l", link: "/etc"}}},
+		{"write beneath symlink", "a.tar", false, []testEntry{
+			{name: "sub", dir: true}, {name: "l", link: "sub"}, {name: "l/f", body: "x"}}},
+		{"zip backslash traversal", "a.zip", true, []testEntry{{name: "..\\evil", body: "x"}}},
+		{"zip symlink escape", "a.zip", true, []testEntry{{name: "l", link: "../evil"}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := testExtractSetup(t)
+			out := filepath.Join(dir, "out")
+			os.Mkdir(out, 0755)
+			fp := filepath.Join(out, tc.file)
+			dat := testTar(t, tc.entries)
+			if tc.zip {
+				dat = testZip(t, tc.entries)
+			}
+			os.WriteFile(fp, dat, 0644)
+
+			if dest, err := extractArchive(fp, fp); err == nil {
+				t.Fatalf("Expected an error, extracted to %q", dest)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "evil")); err == nil {
+				t.Fatal("File written outside of the output directory")
+			}
+			list, _ := os.ReadDir(out)
+			if len(list) != 1 {
+				t.Fatalf("Expected only the archive left, found %d entries", len(list))
+			}
+		})
+	}
+}
+
+func TestExtractArchiveNoOverwrite(t *testing.T) {
+	entries := []testEntry{{name: "d", dir: true}, {name: "d/f.txt", body: "new"}}
+
+	t.Run("existing directory", func(t *testing.T) {
+		dir := testExtractSetup(t)
+		fp := filepath.Join(dir, "a.tar")
+		os.WriteFile(fp, testTar(t, entries), 0644)
+		os.Mkdir(filepath.Join(dir, "a"), 0755)
+		os.WriteFile(filepath.Join(dir, "a", "old.txt"), []byte("old"), 0644)
+		os.Mkdir(filepath.Join(dir, "a.1"), 0755)
+
+		dest, err := extractArchive(fp, fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(dir, "a.2"); dest != want {
+			t.Fatalf("Extracted to %q, want %q", dest, want)
+		}
+		if dat, _ := os.ReadFile(filepath.Join(dir, "a", "old.txt")); string(dat) != "old" {
+			t.Fatal("Existing directory was changed")
+		}
+		if dat, _ := os.ReadFile(filepath.Join(dest, "d", "f.txt")); string(dat) != "new" {
+			t.Fatalf("Extracted content is %q", dat)
+		}
+	})
+
+	t.Run("existing file", func(t *testing.T) {
+		dir := testExtractSetup(t)
+		fp := filepath.Join(dir, "a.zip")
+		os.WriteFile(fp, testZip(t, entries[1:]), 0644)
+		os.WriteFile(filepath.Join(dir, "a"), []byte("old"), 0644)
+
+		dest, err := extractArchive(fp, fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest != filepath.Join(dir, "a.1") {
+			t.Fatalf("Extracted to %q", dest)
+		}
+		if dat, _ := os.ReadFile(filepath.Join(dir, "a")); string(dat) != "old" {
+			t.Fatal("Existing file was changed")
+		}
+	})
+
+	t.Run("no stem", func(t *testing.T) {
+		dir := testExtractSetup(t)
+		fp := filepath.Join(dir, ".tar")
+		os.WriteFile(fp, testTar(t, entries), 0644)
+		os.WriteFile(filepath.Join(dir, "old.txt"), []byte("old"), 0644)
+
+		if _, err := extractArchive(fp, fp); err == nil || !strings.Contains(err.Error(), "No name") {
+			t.Fatalf("Expected to be refused, got %v", err)
+		}
+		if dat, _ := os.ReadFile(filepath.Join(dir, "old.txt")); string(dat) != "old" {
+			t.Fatal("Output directory was changed")
+		}
+	})
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	dir := testExtractSetup(t)
+	*extractMaxSize = "1kB"
+	fp := filepath.Join(dir, "big.tar")
+	os.WriteFile(fp, testTar(t, []testEntry{{name: "f", body: strings.Repeat("x", 4096)}}), 0644)
+	if _, err := extractArchive(fp, fp); err != ErrArchiveLimit {
+		t.Fatalf("Expected the limit error, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "big")); err == nil {
+		t.Fatal("Partial extraction left behind")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -119,3 +120,18 @@ func updateChain(f *flowfile.File, r *http.Request, label string) {
 		}
 	}*/
 }
+
+// A fullReader never returns a short read and hides any ReaderAt, so a file
+// holding several FlowFiles back to back can be scanned sequentially even
+// when the header straddles a buffer boundary.
+type fullReader struct {
+	r io.Reader
+}
+
+func (fr fullReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(fr.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
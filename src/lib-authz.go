@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschou/go-bunit"
+	"github.com/pschou/go-flowfile"
+)
+
+// An authRule grants the clients matching a certificate subject or SAN the
+// right to post to some listen paths, limited in where the FlowFiles may land,
+// how large they may be and how fast they may come.  When rules are loaded,
+// clients which do not match any rule are rejected.
+type authRule struct {
+	Name              string   `json:"name"`
+	Subject           string   `json:"subject"` // Glob on the subject DN, like "*,OU=TeamA,*"
+	SAN               string   `json:"san"`     // Glob on any DNS, email, URI or IP SAN
+	ListenPaths       []string `json:"listenPaths"`
+	PathPrefixes      []string `json:"pathPrefixes"` // Allowed prefixes of the path attribute
+	MaxSize           string   `json:"maxSize"`
+	MaxFilesPerMinute int      `json:"maxFilesPerMinute"`
+	MaxBytesPerMinute string   `json:"maxBytesPerMinute"`
+
+	subject, san *regexp.Regexp
+	maxSize      int64
+	maxBytes     int64
+	clients      map[string]*authWindow
+	mutex        sync.Mutex
+}
+
+// An authWindow counts what a client has sent in the current minute
+type authWindow struct {
+	start        time.Time
+	files, bytes int64
+}
+
+var (
+	authzFile = new(string)
+	authRules []*authRule
+)
+
+func authz_flags() {
+	authzFile = flag.String("authz", "", "JSON file with the client authorization rules, mapping certificate subject or SAN\n"+
+		"patterns to listen paths, path prefixes, maximum sizes and rate limits.  Clients not\n"+
+		"matching any rule are rejected.")
+}
+
+// loadAuthz reads in the authorization rules
+func loadAuthz() {
+	if *authzFile == "" {
+		return
+	}
+	dat, err := os.ReadFile(*authzFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = json.Unmarshal(dat, &authRules); err != nil {
+		log.Fatal("Unable to parse authz file ", err)
+	}
+	fmt.Println("Loading authorization rules from file", *authzFile)
+	for i, a := range authRules {
+		if a.Name == "" {
+			a.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if a.Subject != "" {
+			if a.subject, err = compileGlob(a.Subject); err != nil {
+				log.Fatal("Invalid subject for rule ", a.Name, err)
+			}
+		}
+		if a.SAN != "" {
+			if a.san, err = compileGlob(a.SAN); err != nil {
+				log.Fatal("Invalid san for rule ", a.Name, err)
+			}
+		}
+		if a.MaxSize != "" {
+			if bs, err := bunit.ParseBytes(a.MaxSize); err != nil {
+				log.Fatal("Unable to parse maxSize for rule ", a.Name, err)
+			} else {
+				a.maxSize = bs.Int64()
+			}
+		}
+		if a.MaxBytesPerMinute != "" {
+			if bs, err := bunit.ParseBytes(a.MaxBytesPerMinute); err != nil {
+				log.Fatal("Unable to parse maxBytesPerMinute for rule ", a.Name, err)
+			} else {
+				a.maxBytes = bs.Int64()
+			}
+		}
+		for j, p := range a.PathPrefixes {
+			a.PathPrefixes[j] = path.Clean(p)
+		}
+		a.clients = make(map[string]*authWindow)
+		if *verbose {
+			log.Printf("  Rule %s: subject %q san %q listen %q paths %q max %q rate %d files %q bytes\n", a.Name,
+				a.Subject, a.SAN, a.ListenPaths, a.PathPrefixes, a.MaxSize, a.MaxFilesPerMinute, a.MaxBytesPerMinute)
+		}
+	}
+	fmt.Println("Loaded", len(authRules), "authorization rules.")
+}
+
+// authHandler wraps a handler to reject the clients not matching any rule
+func authHandler(h http.Handler) http.Handler {
+	if len(authRules) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if getAuthRule(r) == nil {
+			log.Println("No authorization rule matched for", r.RemoteAddr, peerSubject(r), r.URL.Path)
+			http.Error(w, "403 not authorized", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// getAuthRule returns the first rule matching the client and listen path
+func getAuthRule(r *http.Request) *authRule {
+	if r == nil {
+		return nil
+	}
+	return matchAuthRule(r, r.URL.Path)
+}
+
+// matchAuthRule returns the first rule matching the client and, unless empty,
+// the listen path
+func matchAuthRule(r *http.Request, listenPath string) *authRule {
+	dn := peerSubject(r)
+	for _, a := range authRules {
+		if listenPath != "" && len(a.ListenPaths) > 0 && !hasString(a.ListenPaths, listenPath) {
+			continue
+		}
+		if a.subject != nil && !a.subject.MatchString(dn) {
+			continue
+		}
+		if a.san != nil && !peerSANMatch(r, a.san) {
+			continue
+		}
+		return a
+	}
+	return nil
+}
+
+// authorize checks a FlowFile against the rule matching the client, when rules
+// are in use.  The rule is returned for recording in the custody chain.
+func authorize(f *flowfile.File, r *http.Request) (*authRule, error) {
+	if len(authRules) == 0 {
+		return nil, nil
+	}
+	a := getAuthRule(r)
+	if a == nil {
+		return nil, rejectf(http.StatusForbidden, "No authorization rule matched")
+	}
+	return a, a.check(f, r)
+}
+
+// check applies the path, size and rate limits of the rule to a FlowFile
+func (a *authRule) check(f *flowfile.File, r *http.Request) error {
+	dir := path.Clean(f.Attrs.Get("path"))
+	name := path.Join(dir, f.Attrs.Get("filename"))
+	if len(a.PathPrefixes) > 0 {
+		allowed := false
+		for _, p := range a.PathPrefixes {
+			if p == "." || dir == p || strings.HasPrefix(dir, p+"/") {
+				allowed = true
+				break
+			}
+		}
+		if !allowed || dir == ".." || strings.HasPrefix(dir, "../") {
+			return rejectf(http.StatusForbidden, "Path of %q not allowed by rule %s", name, a.Name)
+		}
+	}
+
+	_, _, size, err := fragmentInfo(f)
+	if err != nil {
+		return err
+	}
+	if a.maxSize > 0 && size > a.maxSize {
+		return rejectf(http.StatusRequestEntityTooLarge, "Size %v of %q is over the limit of %v for rule %s",
+			bunit.NewBytes(size), name, bunit.NewBytes(a.maxSize), a.Name)
+	}
+
+	if a.MaxFilesPerMinute == 0 && a.maxBytes == 0 {
+		return nil
+	}
+	client := clientKey(r)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	win, ok := a.clients[client]
+	if !ok || time.Since(win.start) >= time.Minute {
+		win = &authWindow{start: time.Now()}
+		a.clients[client] = win
+	}
+	if a.MaxFilesPerMinute > 0 && win.files >= int64(a.MaxFilesPerMinute) {
+		return rejectf(http.StatusTooManyRequests, "Over %d files per minute for rule %s", a.MaxFilesPerMinute, a.Name)
+	}
+	if a.maxBytes > 0 && win.bytes+f.Size > a.maxBytes {
+		return rejectf(http.StatusTooManyRequests, "Over %v per minute for rule %s", bunit.NewBytes(a.maxBytes), a.Name)
+	}
+	win.files++
+	win.bytes += f.Size
+	return nil
+}
+
+// record notes the matched rule on the current hop of the custody chain
+func (a *authRule) record(f *flowfile.File) {
+	if a != nil {
+		f.Attrs.Set("custodyChain.0.authz.rule", a.Name)
+	}
+}
+
+// peerSANMatch tells if any subject alternative name of the client
+// certificate matches
+func peerSANMatch(r *http.Request, re *regexp.Regexp) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	cert := r.TLS.PeerCertificates[0]
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, n := range names {
+		if re.MatchString(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuthRuleSize(t *testing.T) {
+	a := &authRule{Name: "r", maxSize: 100}
+	big := strings.Repeat("x", 200)
+
+	tests := []struct {
+		name  string
+		body  string
+		attrs []string
+		ok    bool
+	}{
+		{"within", "hello", nil, true},
+		{"over", big, nil, false},
+		{"original size on a whole file", big, []string{"segment.original.size", "1"}, false},
+		{"original size below the fragment", big, []string{"fragment.index", "1", "segment.original.size", "1"}, false},
+		{"original size of a fragment", "hello", []string{"fragment.index", "3", "segment.original.size", "1000"}, false},
+		{"fragment within", "hello", []string{"fragment.index", "3", "segment.original.size", "50"}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := testFlowFile(tc.body, append([]string{"filename", "a.txt", "path", "./"}, tc.attrs...)...)
+			err := a.check(f, nil)
+			if tc.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var pe *policyError
+			if !errors.As(err, &pe) || pe.status != http.StatusRequestEntityTooLarge {
+				t.Fatalf("Expected to be too large, got %v", err)
+			}
+		})
+	}
+}
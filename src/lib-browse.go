@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pschou/go-flowfile"
+)
+
+// A read-only HTTP/HTTPS API for browsing and downloading received files on a
+// separate admin port.  Only GET and HEAD are served, nothing is ever written
+// to the output tree through this listener.
+//
+//   GET /files/<path>       directory listing (JSON) or file download
+//   GET /attributes/<path>  stored FlowFile attributes and receive time
+//
+// The listener only runs with TLS client certificates and the clients are
+// held to the same authorization as ingest: when tenants are loaded the first
+// path element is the tenant name and only clients matching that tenant's
+// subject may browse it, and when authorization rules are loaded the client
+// must match a rule and only sees the paths the rule allows.  The attributes
+// are kept in a directory outside of the output tree so no sender can forge
+// them.
+
+var (
+	browseListen = new(string)
+	browseMeta   = new(string)
+)
+
+type browseEntry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir,omitempty"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type browseReceipt struct {
+	Received   time.Time           `json:"received"`
+	Attributes flowfile.Attributes `json:"attributes"`
+}
+
+func browse_flags() {
+	browseListen = flag.String("browse-listen", "", "Serve a read-only API for listing and downloading received files (example :8443)\n"+
+		"Requires -tls and uses the same client certificate authorization as the ingest listener.")
+	browseMeta = flag.String("browse-meta", "ffmeta", "Directory for the attributes of received files served by the browse API,\n"+
+		"must be outside of the output path")
+}
+
+// browseMetaDir is where the receipts of a tenant, or of the base path when
+// there are no tenants, are kept
+func browseMetaDir(t *tenant) string {
+	if t == nil {
+		return path.Join(*browseMeta, "default")
+	}
+	return path.Join(*browseMeta, "tenant", t.Name)
+}
+
+// recordReceipt keeps the attributes and receive time of a file for later
+// lookup through the browse API.
+func recordReceipt(t *tenant, root, fp string, attrs flowfile.Attributes) {
+	if *browseListen == "" {
+		return
+	}
+	rel, err := filepath.Rel(root, fp)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	meta := path.Join(browseMetaDir(t), rel+".json")
+	os.MkdirAll(path.Dir(meta), 0755)
+	dat, _ := json.Marshal(browseReceipt{Received: time.Now(), Attributes: attrs})
+	if err = os.WriteFile(meta, dat, 0644); err != nil && *verbose {
+		log.Println("Unable to record receipt", err)
+	}
+}
+
+// browse_start opens the admin listener in the background.
+func browse_start(defaultRoot string) {
+	if *browseListen == "" {
+		return
+	}
+	if !*enableTLS || tlsConfig == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		log.Fatal("The browse API needs -tls with client certificates")
+	}
+
+	// Receipts kept inside an output tree could be overwritten by a sender
+	roots := []string{defaultRoot}
+	for _, t := range tenants {
+		roots = append(roots, t.Path)
+	}
+	meta, _ := filepath.Abs(*browseMeta)
+	for _, root := range roots {
+		if abs, _ := filepath.Abs(root); meta == abs || strings.HasPrefix(meta, abs+"/") ||
+			strings.HasPrefix(abs, meta+"/") {
+			log.Fatalf("The browse-meta directory %q must be outside of the output path %q", *browseMeta, root)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		browseServe(w, r, defaultRoot, "/files/", false)
+	})
+	mux.HandleFunc("/attributes/", func(w http.ResponseWriter, r *http.Request) {
+		browseServe(w, r, defaultRoot, "/attributes/", true)
+	})
+
+	server := &http.Server{
+		Addr:           *browseListen,
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    time.Minute,
+		WriteTimeout:   10 * time.Hour,
+		MaxHeaderBytes: 1 << 20,
+		Handler:        mux,
+	}
+	go func() {
+		log.Println("Browse API with HTTPS on", *browseListen)
+		log.Fatal(server.ListenAndServeTLS(*certFile, *keyFile))
+	}()
+}
+
+func browseServe(w http.ResponseWriter, r *http.Request, root, prefix string, attrs bool) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 read only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The client must be allowed to send in order to read
+	var rule *authRule
+	if len(authRules) > 0 {
+		if rule = matchAuthRule(r, ""); rule == nil {
+			log.Println("No authorization rule matched for", r.RemoteAddr, peerSubject(r), r.URL.Path)
+			http.Error(w, "403 not authorized", http.StatusForbidden)
+			return
+		}
+	}
+
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, prefix))
+	var tn *tenant
+	if len(tenants) > 0 {
+		// Pick out the tenant and make sure this client is allowed to see it
+		parts := strings.SplitN(strings.TrimPrefix(rel, "/"), "/", 2)
+		dn := peerSubject(r)
+		for _, t := range tenants {
+			if t.Name == parts[0] && (t.subject == nil || t.subject.MatchString(dn)) {
+				tn = t
+				break
+			}
+		}
+		if tn == nil {
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return
+		}
+		root, rel = tn.Path, "/"
+		if len(parts) == 2 {
+			rel = path.Clean("/" + parts[1])
+		}
+	}
+
+	// Only the paths the rule allows sending to may be read, and the
+	// directories above them listed
+	if visible, _ := rule.browsable(rel); !visible {
+		http.NotFound(w, r)
+		return
+	}
+	fp := path.Join(root, rel)
+	if *verbose {
+		log.Println("Browse", r.RemoteAddr, peerSubject(r), fp)
+	}
+
+	if attrs {
+		if _, under := rule.browsable(rel); !under {
+			http.NotFound(w, r)
+			return
+		}
+		dat, err := os.ReadFile(path.Join(browseMetaDir(tn), rel+".json"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(dat)
+		return
+	}
+
+	// Links inside the tree must not lead outside of the root
+	src := casResolve(fp)
+	if src == fp {
+		absRoot, err1 := filepath.EvalSymlinks(root)
+		absFile, err2 := filepath.EvalSymlinks(fp)
+		if err1 != nil || err2 != nil || (absFile != absRoot && !strings.HasPrefix(absFile, absRoot+"/")) {
+			http.NotFound(w, r)
+			return
+		}
+		src = absFile
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !fi.IsDir() {
+		if _, under := rule.browsable(rel); !under {
+			http.NotFound(w, r)
+			return
+		}
+		fh, err := os.Open(src)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer fh.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), fh)
+		return
+	}
+
+	list := []browseEntry{}
+	if dirEntries, err := os.ReadDir(src); err == nil {
+		for _, e := range dirEntries {
+			if visible, _ := rule.browsable(path.Join(rel, e.Name())); !visible {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				list = append(list, browseEntry{Name: e.Name(), Dir: e.IsDir(),
+					Size: info.Size(), Modified: info.ModTime()})
+			}
+		}
+	}
+	for name, e := range casList(fp) {
+		if visible, _ := rule.browsable(path.Join(rel, name)); !visible {
+			continue
+		}
+		list = append(list, browseEntry{Name: name, Size: e.Size, Modified: e.Received})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// browsable tells if a path in the output tree may be seen under the rule,
+// either as a directory above the allowed paths or as under one of them.
+func (a *authRule) browsable(rel string) (visible, under bool) {
+	if a == nil || len(a.PathPrefixes) == 0 {
+		return true, true
+	}
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	if rel == "" {
+		rel = "."
+	}
+	for _, p := range a.PathPrefixes {
+		if p == "." || rel == p || strings.HasPrefix(rel, p+"/") {
+			return true, true
+		}
+		if rel == "." || strings.HasPrefix(p, rel+"/") {
+			visible = true
+		}
+	}
+	return
+}
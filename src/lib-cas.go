@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pschou/go-flowfile"
+)
+
+// Content addressable storage, payloads are stored once by their SHA-256
+// under a sharded objects directory and the user visible tree is built from
+// hard links or a manifest pointing into the object store.  The manifest is kept as a
+// snapshot and an append only journal of the changes since, which is folded
+// into a new snapshot once it grows as large as the manifest.
+
+var (
+	casPath     = new(string)
+	casTree     = new(string)
+	casGCFreq   = new(time.Duration)
+	casLock     sync.Mutex
+	casManifest = make(map[string]casEntry)
+	casJournal  *os.File
+	casJournalN int // Entries in the journal since the snapshot
+)
+
+// A casChange is one line of the manifest journal, a nil entry is a removal
+type casChange struct {
+	Path  string    `json:"path"`
+	Entry *casEntry `json:"entry,omitempty"`
+}
+
+type casEntry struct {
+	Object      string    `json:"object"`
+	Size        int64     `json:"size"`
+	Received    time.Time `json:"received"`
+	Permissions string    `json:"permissions,omitempty"`
+	Modified    string    `json:"modified,omitempty"`
+}
+
+func cas_flags() {
+	casPath = flag.String("cas-path", "", "Enable content addressable storage, payloads are stored once by SHA-256 in this directory\n"+
+		"Example: -cas-path=./objects/")
+	casTree = flag.String("cas-tree", "link", "How to build the output tree from stored objects: \"link\" (hard links) or \"manifest\"")
+	casGCFreq = flag.Duration("cas-gc", time.Hour, "Interval between removing objects which are no longer referenced, set to 0s to disable")
+}
+
+func cas_init() {
+	if *casPath == "" {
+		return
+	}
+	switch *casTree {
+	case "link", "manifest":
+	default:
+		log.Fatalf("Unknown cas-tree %q", *casTree)
+	}
+	if err := os.MkdirAll(path.Join(*casPath, "tmp"), 0755); err != nil {
+		log.Fatal("Unable to create cas-path", err)
+	}
+	log.Println("Content addressable storage set to", *casPath, "using", *casTree)
+
+	if *casTree == "manifest" {
+		if dat, err := os.ReadFile(casManifestFile()); err == nil {
+			if err = json.Unmarshal(dat, &casManifest); err != nil {
+				log.Fatal("Unable to parse manifest", err)
+			}
+		}
+		if err := casReplayJournal(); err != nil {
+			log.Fatal("Unable to read manifest journal", err)
+		}
+		if err := casWriteManifest(); err != nil {
+			log.Fatal("Unable to write manifest", err)
+		}
+		log.Println("Loaded", len(casManifest), "manifest entries")
+	}
+
+	if *casGCFreq > 0 {
+		go func() {
+			for {
+				time.Sleep(*casGCFreq)
+				casGC()
+			}
+		}()
+	}
+}
+
+func casManifestFile() string { return path.Join(*casPath, "manifest.json") }
+func casJournalFile() string  { return path.Join(*casPath, "manifest.journal") }
+
+// casObject returns the sharded location of an object in the store.  Objects
+// are only ever keyed by a SHA-256 computed here, the checksum sent along is
+// for verifying and never picks where content goes.
+func casObject(sum []byte) string {
+	ck := hex.EncodeToString(sum)
+	return path.Join(*casPath, "sha256", ck[0:2], ck[2:4], ck)
+}
+
+// casHashFile computes the object key of a file already on disk
+func casHashFile(fp string) (string, error) {
+	fh, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return casObject(h.Sum(nil)), nil
+}
+
+// casSave writes the payload of a FlowFile into the object store, the
+// payload is hashed as it is read and, when a checksum was sent, only
+// verified content is kept.  The dup result tells when the object was
+// already in the store.
+func casSave(f *flowfile.File, fp string) (obj string, dup bool, err error) {
+	tmp := path.Join(*casPath, "tmp", randStringBytes(16))
+	var fh *os.File
+	if fh, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+		return
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fh, h), f)
+	fh.Close()
+	if err == nil && f.Attrs.Get("checksum") != "" && f.Attrs.Get("checksumType") != "" {
+		err = f.Verify()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	obj = casObject(h.Sum(nil))
+	dup, err = casCommit(tmp, obj, fp, f)
+	return
+}
+
+// casCommit moves a verified file into the object store and places a reference
+// to it in the output tree.  If the object is already present the duplicate is
+// dropped and dup is set.
+func casCommit(src, obj, fp string, f *flowfile.File) (dup bool, err error) {
+	casLock.Lock()
+	defer casLock.Unlock()
+
+	if _, err = os.Stat(obj); err == nil {
+		dup = true
+		os.Remove(src)
+		// Refresh the time so a pending garbage collection keeps the object
+		now := time.Now()
+		os.Chtimes(obj, now, now)
+		if *verbose {
+			log.Println("  Deduplicated", fp, "to", obj)
+		}
+	} else {
+		if err = os.MkdirAll(path.Dir(obj), 0755); err != nil {
+			return
+		}
+		if err = os.Rename(src, obj); err != nil {
+			return
+		}
+		os.Chmod(obj, 0444)
+	}
+
+	switch *casTree {
+	case "link":
+		os.Remove(fp)
+		err = os.Link(obj, fp)
+	case "manifest":
+		st, _ := os.Stat(obj)
+		e := casEntry{
+			Object:      obj,
+			Size:        st.Size(),
+			Received:    time.Now(),
+			Permissions: f.Attrs.Get("file.permissions"),
+			Modified:    f.Attrs.Get("file.lastModifiedTime"),
+		}
+		casManifest[filepath.Clean(fp)] = e
+		err = casAppendJournal(casChange{Path: filepath.Clean(fp), Entry: &e})
+	}
+	return
+}
+
+// casRemove drops a reference from the output tree
+func casRemove(fp string) {
+	casLock.Lock()
+	defer casLock.Unlock()
+	switch *casTree {
+	case "link":
+		os.Remove(fp)
+	case "manifest":
+		delete(casManifest, filepath.Clean(fp))
+		casAppendJournal(casChange{Path: filepath.Clean(fp)})
+	}
+}
+
+// casResolve returns the path where the content for a given output file can
+// be read from.
+func casResolve(fp string) string {
+	if *casPath != "" && *casTree == "manifest" {
+		casLock.Lock()
+		defer casLock.Unlock()
+		if e, ok := casManifest[filepath.Clean(fp)]; ok {
+			return e.Object
+		}
+	}
+	return fp
+}
+
+// casList returns the manifest entries which are directly in a directory of
+// the output tree, keyed by file name.
+func casList(dir string) map[string]casEntry {
+	out := make(map[string]casEntry)
+	if *casPath == "" || *casTree != "manifest" {
+		return out
+	}
+	dir = filepath.Clean(dir)
+	casLock.Lock()
+	defer casLock.Unlock()
+	for fp, e := range casManifest {
+		if d, name := filepath.Split(fp); filepath.Clean(d) == dir {
+			out[name] = e
+		}
+	}
+	return out
+}
+
+// Write the manifest out to a temporary file and move it into place so a crash
+// never leaves a partial manifest, then start a new journal.  Must be called
+// with the casLock held.
+func casWriteManifest() error {
+	dat, err := json.MarshalIndent(casManifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := casManifestFile() + ".tmp"
+	if err = os.WriteFile(tmp, dat, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, casManifestFile()); err != nil {
+		return err
+	}
+	if casJournal != nil {
+		casJournal.Close()
+	}
+	casJournal, err = os.OpenFile(casJournalFile(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	casJournalN = 0
+	return err
+}
+
+// casAppendJournal records a change to the manifest, folding the journal into
+// a new snapshot once it holds as many entries as the manifest so the work
+// per change stays constant.  Must be called with the casLock held.
+func casAppendJournal(c casChange) error {
+	dat, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if _, err = casJournal.Write(append(dat, '\n')); err != nil {
+		return err
+	}
+	if casJournalN++; casJournalN >= 1000 && casJournalN >= len(casManifest) {
+		return casWriteManifest()
+	}
+	return nil
+}
+
+// casReplayJournal applies the changes recorded since the last snapshot, a
+// partial line left by a crash is skipped.
+func casReplayJournal() error {
+	fh, err := os.Open(casJournalFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fh.Close()
+	sc := bufio.NewScanner(fh)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		var c casChange
+		if json.Unmarshal(sc.Bytes(), &c) != nil || c.Path == "" {
+			continue
+		}
+		if c.Entry != nil {
+			casManifest[c.Path] = *c.Entry
+		} else {
+			delete(casManifest, c.Path)
+		}
+	}
+	return sc.Err()
+}
+
+// casGC removes objects which are no longer referenced by the output tree.
+// When using links, an object with a single link is only held by the store.
+func casGC() {
+	var referenced map[string]struct{}
+	if *casTree == "manifest" {
+		casLock.Lock()
+		referenced = make(map[string]struct{})
+		for _, e := range casManifest {
+			referenced[e.Object] = struct{}{}
+		}
+		casLock.Unlock()
+	}
+
+	var removed int
+	tmpDir := path.Join(*casPath, "tmp")
+	filepath.Walk(*casPath, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() {
+			if fp == tmpDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fp == casManifestFile() || fp == casJournalFile() || !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		// Look again while holding the lock as a receive may have just linked it
+		casLock.Lock()
+		defer casLock.Unlock()
+		if fi, err = os.Stat(fp); err != nil {
+			return nil
+		}
+		switch *casTree {
+		case "link":
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink <= 1 {
+				if os.Remove(fp) == nil {
+					removed++
+				}
+			}
+		case "manifest":
+			if _, ok := referenced[fp]; !ok && time.Now().Sub(fi.ModTime()) > *casGCFreq {
+				if os.Remove(fp) == nil {
+					removed++
+				}
+			}
+		}
+		return nil
+	})
+	if removed > 0 || *verbose {
+		log.Println("Garbage collection removed", removed, "unreferenced objects")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pschou/go-flowfile"
+)
+
+// Malware scanning with a clamd compatible daemon, the content is streamed
+// with the INSTREAM command and the verdict is recorded in the attributes:
+//
+//   scan.result     OK, FOUND or ERROR
+//   scan.signature  name of what was found
+//   scan.engine     clamd
+//   scan.time       when the scan was done
+
+var (
+	clamdAddr    = new(string)
+	clamdFail    = new(string)
+	clamdTimeout = new(time.Duration)
+
+	scanInfected, scanErrors int64
+)
+
+func clamd_flags() {
+	clamdAddr = flag.String("clamd", "", "Address of a clamd compatible scanner to check every FlowFile with before\n"+
+		"forwarding, such as tcp://127.0.0.1:3310 or unix:///run/clamav/clamd.ctl")
+	clamdFail = flag.String("clamd-fail", "closed", "When the scanner cannot be used: closed to refuse the FlowFile, open to forward it")
+	clamdTimeout = flag.Duration("clamd-timeout", 5*time.Minute, "Time allowed for a scan")
+}
+
+func clamd_init() {
+	if *clamdAddr == "" {
+		return
+	}
+	if *clamdFail != "closed" && *clamdFail != "open" {
+		log.Fatal("Invalid clamd-fail, use closed or open")
+	}
+	log.Println("Scanning with clamd at", *clamdAddr, "failing", *clamdFail)
+	metricsGauges["flowfiles_scan_infected"] = func() int64 { return atomic.LoadInt64(&scanInfected) }
+	metricsGauges["flowfiles_scan_errors"] = func() int64 { return atomic.LoadInt64(&scanErrors) }
+}
+
+// scanning tells if FlowFiles are to be scanned
+func scanning() bool { return *clamdAddr != "" }
+
+// scanFlowFile scans the content read from r, recording the verdict in the
+// attributes of f.  Infected content is refused, as is content which could
+// not be scanned when failing closed.
+func scanFlowFile(f *flowfile.File, r io.Reader) error {
+	name := f.Attrs.Get("filename")
+	sig, err := clamScan(r)
+	f.Attrs.Set("scan.engine", "clamd")
+	f.Attrs.Set("scan.time", time.Now().UTC().Format(time.RFC3339))
+	switch {
+	case err != nil:
+		atomic.AddInt64(&scanErrors, 1)
+		f.Attrs.Set("scan.result", "ERROR")
+		if *clamdFail == "open" {
+			log.Println("  Unable to scan", name, err, "(failing open)")
+			return nil
+		}
+		return rejectf(http.StatusServiceUnavailable, "Unable to scan %q: %v", name, err)
+	case sig != "":
+		atomic.AddInt64(&scanInfected, 1)
+		f.Attrs.Set("scan.result", "FOUND")
+		f.Attrs.Set("scan.signature", sig)
+		return rejectf(http.StatusForbidden, "Found %s in %q", sig, name)
+	}
+	f.Attrs.Set("scan.result", "OK")
+	if *verbose {
+		log.Println("    Scanned", name, "clean")
+	}
+	return nil
+}
+
+// clamScan streams the content to clamd, returning the signature found
+func clamScan(r io.Reader) (sig string, err error) {
+	network, addr := "tcp", *clamdAddr
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "/"):
+		network = "unix"
+	default:
+		addr = strings.TrimPrefix(addr, "tcp://")
+	}
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(*clamdTimeout))
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return
+	}
+	buf := make([]byte, 4+32<<10)
+	for {
+		n, rerr := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				// clamd hangs up when over its StreamMaxLength, read the reason
+				break
+			}
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return "", rerr
+		}
+	}
+	if err == nil {
+		_, err = conn.Write([]byte{0, 0, 0, 0})
+	}
+
+	reply, rerr := io.ReadAll(conn)
+	reply = bytes.TrimRight(reply, "\x00\n")
+	if len(reply) == 0 {
+		if err == nil {
+			err = rerr
+		}
+		if err == nil {
+			err = fmt.Errorf("Empty reply from clamd")
+		}
+		return
+	}
+	// Replies look like "stream: OK" or "stream: Eicar-Signature FOUND"
+	res := strings.TrimPrefix(string(reply), "stream: ")
+	switch {
+	case res == "OK":
+		return "", nil
+	case strings.HasSuffix(res, " FOUND"):
+		return strings.TrimSuffix(res, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", res)
+}
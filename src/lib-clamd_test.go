@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschou/go-flowfile"
+)
+
+// fakeClamd answers INSTREAM scans like clamd, handing the streamed content to
+// reply for the verdict.  A limit above zero hangs up once that many bytes
+// were streamed, as clamd does past its StreamMaxLength.
+type fakeClamd struct {
+	ln       net.Listener
+	reply    func(dat []byte) string
+	limit    int
+	commands chan string
+	streamed chan []byte
+}
+
+func newFakeClamd(t *testing.T, network, addr string, reply func([]byte) string) *fakeClamd {
+	t.Helper()
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &fakeClamd{ln: ln, reply: reply, commands: make(chan string, 10), streamed: make(chan []byte, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go fc.serve()
+	return fc
+}
+
+func (fc *fakeClamd) serve() {
+	for {
+		conn, err := fc.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fc.handle(conn)
+	}
+}
+
+func (fc *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	var cmd []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return
+		}
+		if b[0] == 0 {
+			break
+		}
+		cmd = append(cmd, b[0])
+	}
+	fc.commands <- string(cmd)
+
+	var dat []byte
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			return
+		}
+		dat = append(dat, chunk...)
+		if fc.limit > 0 && len(dat) > fc.limit {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+	}
+	fc.streamed <- dat
+	conn.Write([]byte(fc.reply(dat) + "\x00"))
+}
+
+func eicarReply(dat []byte) string {
+	if bytes.Contains(dat, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func testClamdSetup(t *testing.T, addr, fail string) {
+	t.Helper()
+	oldAddr, oldFail, oldTimeout := *clamdAddr, *clamdFail, *clamdTimeout
+	*clamdAddr, *clamdFail, *clamdTimeout = addr, fail, 5*time.Second
+	t.Cleanup(func() { *clamdAddr, *clamdFail, *clamdTimeout = oldAddr, oldFail, oldTimeout })
+}
+
+func testScan(body string) (*flowfile.File, error) {
+	f := flowfile.New(strings.NewReader(body), int64(len(body)))
+	f.Attrs.Set("filename", "test.txt")
+	return f, scanFlowFile(f, strings.NewReader(body))
+}
+
+func TestClamdInstream(t *testing.T) {
+	fc := newFakeClamd(t, "tcp", "127.0.0.1:0", eicarReply)
+	testClamdSetup(t, "tcp://"+fc.ln.Addr().String(), "closed")
+
+	// Larger than one chunk so the content is streamed in pieces
+	body := strings.Repeat("0123456789abcdef", 5000)
+	f, err := testScan(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := <-fc.commands; cmd != "zINSTREAM" {
+		t.Fatalf("Sent command %q", cmd)
+	}
+	if dat := <-fc.streamed; string(dat) != body {
+		t.Fatalf("Streamed %d bytes, want %d", len(dat), len(body))
+	}
+	if res := f.Attrs.Get("scan.result"); res != "OK" {
+		t.Fatalf("scan.result is %q", res)
+	}
+	if f.Attrs.Get("scan.engine") != "clamd" || f.Attrs.Get("scan.time") == "" {
+		t.Fatal("Scan attributes missing")
+	}
+}
+
+func TestClamdFound(t *testing.T) {
+	fc := newFakeClamd(t, "tcp", "127.0.0.1:0", eicarReply)
+	testClamdSetup(t, fc.ln.Addr().String(), "open")
+
+	// Found is refused even when failing open
+	f, err := testScan(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+	var pe *policyError
+	if !errors.As(err, &pe) || pe.status != http.StatusForbidden {
+		t.Fatalf("Expected to be forbidden, got %v", err)
+	}
+	if f.Attrs.Get("scan.result") != "FOUND" || f.Attrs.Get("scan.signature") != "Eicar-Test-Signature" {
+		t.Fatalf("Attributes are %q %q", f.Attrs.Get("scan.result"), f.Attrs.Get("scan.signature"))
+	}
+}
+
+func TestClamdUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "clamd.ctl")
+	newFakeClamd(t, "unix", sock, eicarReply)
+	for _, addr := range []string{"unix://" + sock, sock} {
+		testClamdSetup(t, addr, "closed")
+		if _, err := testScan("clean"); err != nil {
+			t.Fatalf("Scan with %q failed: %v", addr, err)
+		}
+	}
+}
+
+func TestClamdFailure(t *testing.T) {
+	// A listener closed right away leaves an address nothing answers on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name   string
+		reply  func([]byte) string
+		limit  int
+		body   string
+		status int // Zero when the FlowFile is let through
+	}{
+		{"unreachable closed", nil, 0, "x", http.StatusServiceUnavailable},
+		{"unreachable open", nil, 0, "x", 0},
+		{"error reply closed", func([]byte) string { return "stream: lstat() failed ERROR" }, 0, "x", http.StatusServiceUnavailable},
+		{"error reply open", func([]byte) string { return "stream: lstat() failed ERROR" }, 0, "x", 0},
+		{"empty reply closed", func([]byte) string { return "" }, 0, "x", http.StatusServiceUnavailable},
+		{"over stream limit closed", eicarReply, 1000, strings.Repeat("x", 100000), http.StatusServiceUnavailable},
+		{"over stream limit open", eicarReply, 1000, strings.Repeat("x", 100000), 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := down
+			if tc.reply != nil {
+				fc := newFakeClamd(t, "tcp", "127.0.0.1:0", tc.reply)
+				fc.limit = tc.limit
+				addr = fc.ln.Addr().String()
+			}
+			fail := "closed"
+			if tc.status == 0 {
+				fail = "open"
+			}
+			testClamdSetup(t, addr, fail)
+
+			f, err := testScan(tc.body)
+			if res := f.Attrs.Get("scan.result"); res != "ERROR" {
+				t.Fatalf("scan.result is %q", res)
+			}
+			if tc.status == 0 {
+				if err != nil {
+					t.Fatalf("Expected to fail open, got %v", err)
+				}
+				return
+			}
+			var pe *policyError
+			if !errors.As(err, &pe) || pe.status != tc.status {
+				t.Fatalf("Expected status %d, got %v", tc.status, err)
+			}
+		})
+	}
+}
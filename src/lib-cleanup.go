@@ -9,6 +9,9 @@ import (
 	"github.com/pschou/go-tempfile"
 )
 
+// Functions to be called before exiting on an interrupt
+var cleanupHooks []func()
+
 func init() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -17,6 +20,9 @@ func init() {
 			if *debug {
 				log.Println("Caught signal", sig)
 			}
+			for _, hook := range cleanupHooks {
+				hook()
+			}
 			tempfile.Cleanup()
 			memdiskbuf.Cleanup()
 			os.Exit(1)
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschou/go-bunit"
+	"github.com/pschou/go-flowfile"
+	"github.com/pschou/go-iothrottler"
+)
+
+// Per client limits, a client being known by the subject DN of its certificate
+// or else its source IP.  Ingress is shaped to a bandwidth and the bytes
+// accepted are counted against daily and monthly quotas.
+
+const clientChunk = 16 << 10
+
+var (
+	clientRateStr    = new(string)
+	clientDailyStr   = new(string)
+	clientMonthlyStr = new(string)
+	clientUsageFile  = new(string)
+
+	clientRate    *bunit.BitRate
+	clientDaily   int64
+	clientMonthly int64
+	clientLimited bool
+	clientUsages  = make(map[string]*clientUsage)
+	clientLock    sync.Mutex
+)
+
+// A clientUsage is what a client has sent in the current day and month
+type clientUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"dayBytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"monthBytes"`
+	Total      int64  `json:"total"`
+
+	limit *iothrottler.Limit
+}
+
+func client_flags() {
+	clientRateStr = flag.String("client-rate", "", "Ingress bandwidth limit per client, for example 20Mbps")
+	clientDailyStr = flag.String("client-daily-quota", "", "Bytes each client may send per day, for example 100GB")
+	clientMonthlyStr = flag.String("client-monthly-quota", "", "Bytes each client may send per month, for example 2TB")
+	clientUsageFile = flag.String("client-usage", "", "JSON file in which to keep the client usage across restarts")
+}
+
+// client_init parses the limits and loads the usage saved before a restart
+func client_init() {
+	var err error
+	if *clientRateStr != "" {
+		if clientRate, err = bunit.ParseBitRate(*clientRateStr); err != nil {
+			log.Fatal("Unable to parse client-rate ", err)
+		}
+		log.Println("Client bandwidth limited to", clientRate)
+	}
+	if *clientDailyStr != "" {
+		if bs, err := bunit.ParseBytes(*clientDailyStr); err != nil {
+			log.Fatal("Unable to parse client-daily-quota ", err)
+		} else {
+			clientDaily = bs.Int64()
+		}
+	}
+	if *clientMonthlyStr != "" {
+		if bs, err := bunit.ParseBytes(*clientMonthlyStr); err != nil {
+			log.Fatal("Unable to parse client-monthly-quota ", err)
+		} else {
+			clientMonthly = bs.Int64()
+		}
+	}
+	if clientDaily > 0 || clientMonthly > 0 {
+		log.Printf("Client quotas set to %q daily and %q monthly\n", *clientDailyStr, *clientMonthlyStr)
+	}
+	clientLimited = clientRate != nil || clientDaily > 0 || clientMonthly > 0
+
+	if *clientUsageFile != "" {
+		if dat, err := os.ReadFile(*clientUsageFile); err == nil {
+			if err = json.Unmarshal(dat, &clientUsages); err != nil {
+				log.Fatal("Unable to parse client usage file ", err)
+			}
+			log.Println("Loaded usage of", len(clientUsages), "clients from", *clientUsageFile)
+		}
+		cleanupHooks = append(cleanupHooks, clientSave)
+		go func() {
+			for {
+				time.Sleep(time.Minute)
+				clientSave()
+			}
+		}()
+	}
+
+	metricsSources = append(metricsSources, func(host, action string) string {
+		clientLock.Lock()
+		defer clientLock.Unlock()
+		var keys []string
+		for k := range clientUsages {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var out strings.Builder
+		tm := time.Now().UnixMilli()
+		for _, k := range keys {
+			u := clientUsages[k]
+			u.rollover(time.Now())
+			fmt.Fprintf(&out, "flowfiles_client_bytes_day{host=%q,action=%q,client=%q} %d %d\n", host, action, k, u.DayBytes, tm)
+			fmt.Fprintf(&out, "flowfiles_client_bytes_month{host=%q,action=%q,client=%q} %d %d\n", host, action, k, u.MonthBytes, tm)
+			fmt.Fprintf(&out, "flowfiles_client_bytes_total{host=%q,action=%q,client=%q} %d %d\n", host, action, k, u.Total, tm)
+		}
+		return out.String()
+	})
+}
+
+// clientKey names the client of a request
+func clientKey(r *http.Request) string {
+	if dn := peerSubject(r); dn != "" {
+		return dn
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return host
+}
+
+// clientGet returns the usage of a client, clientLock must be held
+func clientGet(key string) *clientUsage {
+	u, ok := clientUsages[key]
+	if !ok {
+		u = &clientUsage{}
+		clientUsages[key] = u
+	}
+	u.rollover(time.Now())
+	return u
+}
+
+// rollover starts the counts over on a new day or month
+func (u *clientUsage) rollover(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// over tells if n more bytes would exceed a quota and when to try again
+func (u *clientUsage) over(n int64, now time.Time) (time.Duration, bool) {
+	if clientMonthly > 0 && u.MonthBytes+n > clientMonthly {
+		next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+		return next.Sub(now), true
+	}
+	if clientDaily > 0 && u.DayBytes+n > clientDaily {
+		next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		return next.Sub(now), true
+	}
+	return 0, false
+}
+
+// clientHandler wraps a handler to refuse clients over their quota and to
+// shape the bandwidth of the rest.
+func clientHandler(h http.Handler) http.Handler {
+	if !clientLimited {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		key := clientKey(r)
+		clientLock.Lock()
+		u := clientGet(key)
+		after, over := u.over(1, time.Now())
+		if !over && clientRate != nil && u.limit == nil {
+			u.limit = iothrottler.NewLimit(clientRate, clientChunk, 0)
+		}
+		limit := u.limit
+		clientLock.Unlock()
+
+		if over {
+			log.Println("Quota exceeded for", key, r.RemoteAddr)
+			replyError(w, retryf(after, "429 quota exceeded for %s", key))
+			return
+		}
+		if limit != nil {
+			r.Body = &throttledBody{ReadCloser: r.Body, limit: limit}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientCharge counts a FlowFile against the quotas of the client, refusing
+// it when they would be exceeded.
+func clientCharge(f *flowfile.File, r *http.Request) error {
+	if !clientLimited || r == nil {
+		return nil
+	}
+	key, now := clientKey(r), time.Now()
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	u := clientGet(key)
+	if after, over := u.over(f.Size, now); over {
+		return retryf(after, "Quota exceeded for %s, %v sent today and %v this month", key,
+			bunit.NewBytes(u.DayBytes), bunit.NewBytes(u.MonthBytes))
+	}
+	u.DayBytes += f.Size
+	u.MonthBytes += f.Size
+	u.Total += f.Size
+	return nil
+}
+
+// clientSave writes out the usage to keep it across restarts
+func clientSave() {
+	clientLock.Lock()
+	dat, err := json.Marshal(clientUsages)
+	clientLock.Unlock()
+	if err == nil {
+		tmp := *clientUsageFile + ".tmp"
+		if err = os.WriteFile(tmp, dat, 0644); err == nil {
+			err = os.Rename(tmp, *clientUsageFile)
+		}
+	}
+	if err != nil {
+		log.Println("Unable to save client usage", err)
+	}
+}
+
+// A throttledBody paces the reads of a request body to the client bandwidth
+type throttledBody struct {
+	io.ReadCloser
+	limit  *iothrottler.Limit
+	credit int
+}
+
+func (t *throttledBody) Read(p []byte) (n int, err error) {
+	if t.credit <= 0 {
+		<-t.limit.C
+		t.credit += clientChunk
+	}
+	if len(p) > t.credit {
+		p = p[:t.credit]
+	}
+	n, err = t.ReadCloser.Read(p)
+	t.credit -= n
+	return
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Forward error correction over the UDP link groups the chunks of a payload
+// into blocks of data shards and sends Reed-Solomon parity shards after them,
+// so the receiving side can rebuild lost chunks without a second send.  The
+// blocks are interleaved, a group of data*depth chunks is split so that chunk
+// i of the group is in block i%depth, spreading a burst of losses over the
+// blocks of the group.
+//
+// A parity packet carries a fecHeader ahead of the shard and an offset past
+// the end of the payload, (total chunks + block * parity + index) * MTU, so
+// receivers without FEC drop them as out of range.
+type fecHeader struct {
+	Data, Parity, Depth uint16
+}
+
+const (
+	fecHeaderSize = 6
+	fecRingChunks = 1024 // Chunks kept by the receiver, twice the largest group
+)
+
+var (
+	fecEncoders    = make(map[[2]int]reedsolomon.Encoder)
+	fecEncoderLock sync.Mutex
+)
+
+// parseFEC reads a data:parity shard spec, 0 disables the correction
+func parseFEC(spec string, depth int) (data, parity int, err error) {
+	if spec == "" || spec == "0" {
+		return
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid FEC %q, expected data:parity", spec)
+	}
+	if data, err = strconv.Atoi(parts[0]); err == nil {
+		parity, err = strconv.Atoi(parts[1])
+	}
+	if err != nil || data < 1 || parity < 1 || data+parity > 256 {
+		return 0, 0, fmt.Errorf("Invalid FEC %q, the shards must add up to at most 256", spec)
+	}
+	if depth < 1 || data*depth > fecRingChunks/2 {
+		return 0, 0, fmt.Errorf("Invalid FEC interleave %d, the data chunks times the depth must be at most %d",
+			depth, fecRingChunks/2)
+	}
+	return
+}
+
+// fecEncoder returns an encoder for the shard counts, shared as they are safe
+// for concurrent use
+func fecEncoder(data, parity int) (enc reedsolomon.Encoder, err error) {
+	fecEncoderLock.Lock()
+	defer fecEncoderLock.Unlock()
+	key := [2]int{data, parity}
+	if enc = fecEncoders[key]; enc == nil {
+		if enc, err = reedsolomon.New(data, parity); err == nil {
+			fecEncoders[key] = enc
+		}
+	}
+	return
+}
+
+// fecChunk returns the payload chunk of shard k in a block, the chunks of a
+// block are spaced by the depth within its group
+func fecChunk(block, k, data, depth int) int {
+	return block/depth*data*depth + block%depth + k*depth
+}
+
+// fecParityChunk returns the chunk offset parity shard p of a block is sent
+// at, past the total chunks of the payload
+func fecParityChunk(total, block, p, parity int) int {
+	return total + block*parity + p
+}
+
+// fecShard returns where chunk k of a group is kept by the sender, the group
+// is split into len(shards) blocks
+func fecShard(shards [][][]byte, k int) []byte {
+	return shards[k%len(shards)][k/len(shards)]
+}
+
+// fecEncodeGroup fills in the parity of a group of k chunks, the chunks past
+// the end of the payload are zeros
+func fecEncodeGroup(shards [][][]byte, k, data, parity int) error {
+	for ; k < data*len(shards); k++ {
+		shard := fecShard(shards, k)
+		for i := range shard {
+			shard[i] = 0
+		}
+	}
+	enc, err := fecEncoder(data, parity)
+	if err != nil {
+		return err
+	}
+	for _, block := range shards {
+		if err = enc.Encode(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fecRebuild gathers the shards of a block and rebuilds the missing data
+// shards.  The chunk func returns a chunk padded to the MTU, or nil when it has
+// not come in, and ps holds the parity shards in, nil for the ones missing.
+// Nil shards are returned when too few are here yet.
+func fecRebuild(data, parity, depth, block, total, mtu int, chunk func(i int) []byte, ps [][]byte) ([][]byte, error) {
+	shards := make([][]byte, data+parity)
+	have := 0
+	for k := 0; k < data; k++ {
+		if i := fecChunk(block, k, data, depth); i >= total {
+			shards[k] = make([]byte, mtu)
+		} else if shards[k] = chunk(i); shards[k] == nil {
+			continue
+		}
+		have++
+	}
+	for k, s := range ps {
+		if s != nil {
+			shards[data+k] = s
+			have++
+		}
+	}
+	if have < data {
+		return nil, nil
+	}
+
+	enc, err := fecEncoder(data, parity)
+	if err == nil {
+		err = enc.ReconstructData(shards)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// testFECSend splits the payload into chunks as the sender does and returns
+// the chunks on the wire, the parity at the chunk offsets past the payload
+func testFECSend(t *testing.T, payload []byte, data, parity, depth, mtu int) map[int][]byte {
+	t.Helper()
+	shards := make([][][]byte, depth)
+	for b := range shards {
+		shards[b] = make([][]byte, data+parity)
+		for i := range shards[b] {
+			shards[b][i] = make([]byte, mtu)
+		}
+	}
+	total := (len(payload)-1)/mtu + 1
+	wire := make(map[int][]byte)
+	var k, group int
+	for i := 0; i < total; i++ {
+		chunk := payload[i*mtu:]
+		if len(chunk) > mtu {
+			chunk = chunk[:mtu]
+		}
+		wire[i] = chunk
+		shard := fecShard(shards, k)
+		for j := copy(shard, chunk); j < mtu; j++ {
+			shard[j] = 0
+		}
+		if k++; k == data*depth || i == total-1 {
+			if err := fecEncodeGroup(shards, k, data, parity); err != nil {
+				t.Fatal(err)
+			}
+			for p := 0; p < parity; p++ {
+				for b, block := range shards {
+					wire[fecParityChunk(total, group*depth+b, p, parity)] = append([]byte{}, block[data+p]...)
+				}
+			}
+			k, group = 0, group+1
+		}
+	}
+	return wire
+}
+
+func TestFECRebuild(t *testing.T) {
+	const data, parity, depth, mtu = 4, 2, 3, 16
+	// Two full groups of 12 chunks and a short group of 7, the last one partial
+	payload := make([]byte, 31*mtu-5)
+	rand.New(rand.NewSource(1)).Read(payload)
+	total := (len(payload)-1)/mtu + 1
+	blocks := (total-1)/(data*depth)*depth + depth
+
+	tests := []struct {
+		name string
+		drop func(i int) bool // Chunk offsets lost on the wire
+		lost int              // Chunks expected to stay lost
+	}{
+		{"none", func(i int) bool { return false }, 0},
+		{"parity per block", func(i int) bool {
+			for b := 0; b < blocks; b++ {
+				for k := 0; k < parity; k++ {
+					if i < total && fecChunk(b, k, data, depth) == i {
+						return true
+					}
+				}
+			}
+			return false
+		}, 0},
+		{"data and parity", func(i int) bool {
+			for b := 0; b < blocks; b++ {
+				if i < total && i == fecChunk(b, data-1, data, depth) || i == fecParityChunk(total, b, 0, parity) {
+					return true
+				}
+			}
+			return false
+		}, 0},
+		{"burst across the interleave", func(i int) bool { return i >= 12 && i < 12+parity*depth }, 0},
+		{"short final group", func(i int) bool { return i == total-1 || i == total-4 }, 0},
+		{"all parity", func(i int) bool { return i >= total }, 0},
+		{"too many in a block", func(i int) bool {
+			for k := 0; k <= parity; k++ {
+				if fecChunk(1, k, data, depth) == i {
+					return true
+				}
+			}
+			return false
+		}, parity + 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			wire := testFECSend(t, payload, data, parity, depth, mtu)
+			got := make(map[int][]byte)
+			ps := make(map[int][][]byte)
+			for i, p := range wire {
+				if tc.drop(i) {
+					continue
+				}
+				if i < total {
+					got[i] = append(make([]byte, 0, mtu), p...)
+					continue
+				}
+				block := (i - total) / parity
+				if ps[block] == nil {
+					ps[block] = make([][]byte, parity)
+				}
+				ps[block][(i-total)%parity] = p
+			}
+
+			// Rebuild as the receiver does, the chunks padded out to the MTU
+			for block, p := range ps {
+				shards, err := fecRebuild(data, parity, depth, block, total, mtu, func(i int) []byte {
+					if c, ok := got[i]; ok {
+						return c[:mtu]
+					}
+					return nil
+				}, p)
+				if err != nil || shards == nil {
+					continue
+				}
+				for k := 0; k < data; k++ {
+					if i := fecChunk(block, k, data, depth); i < total && got[i] == nil {
+						size := mtu
+						if last := len(payload) - i*mtu; last < size {
+							size = last
+						}
+						got[i] = shards[k][:size]
+					}
+				}
+			}
+
+			lost := 0
+			for i := 0; i < total; i++ {
+				if c, ok := got[i]; !ok {
+					lost++
+				} else if !bytes.Equal(c, wire[i]) {
+					t.Fatalf("Chunk %d rebuilt wrong", i)
+				}
+			}
+			if lost != tc.lost {
+				t.Fatalf("Expected %d chunks lost, got %d", tc.lost, lost)
+			}
+		})
+	}
+}
+
+func TestFECInterleave(t *testing.T) {
+	// Every chunk of a group is in exactly one block at the shard the sender
+	// keeps it in
+	const data, depth = 5, 4
+	shards := make([][][]byte, depth)
+	for b := range shards {
+		shards[b] = make([][]byte, data)
+		for k := range shards[b] {
+			shards[b][k] = []byte{byte(b), byte(k)}
+		}
+	}
+	for group := 0; group < 3; group++ {
+		for k := 0; k < data*depth; k++ {
+			s := fecShard(shards, k)
+			block := group*depth + int(s[0])
+			if i := fecChunk(block, int(s[1]), data, depth); i != group*data*depth+k {
+				t.Fatalf("Chunk %d of group %d is found at %d", k, group, i)
+			}
+		}
+	}
+}
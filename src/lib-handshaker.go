@@ -11,6 +11,16 @@ import (
 // This function periodically handshakes the connections to maintain state
 
 func handshaker(hs *flowfile.HTTPTransaction, ffReceiver *flowfile.HTTPReceiver) {
+	if hs == nil {
+		handshakers(nil, ffReceiver)
+	} else {
+		handshakers([]*flowfile.HTTPTransaction{hs}, ffReceiver)
+	}
+}
+
+// handshakers keeps the receiver max-size at the smallest of the local setting
+// and the sizes allowed by every downstream transaction.
+func handshakers(hss []*flowfile.HTTPTransaction, ffReceiver *flowfile.HTTPReceiver) {
 	var localMaxPartitionSize, new int64
 	if *maxSize != "" {
 		if bs, err := bunit.ParseBytes(*maxSize); err != nil {
@@ -23,24 +33,26 @@ func handshaker(hs *flowfile.HTTPTransaction, ffReceiver *flowfile.HTTPReceiver)
 	}
 
 	// Don't need to do checks on the transaction side as they will never happen
-	if hs == nil {
+	if len(hss) == 0 {
 		return
 	}
 
 	go func() {
 		for {
 			new = localMaxPartitionSize
-			if hs.MaxPartitionSize > 0 || new > 0 {
-				if new == 0 || (hs.MaxPartitionSize > 0 && hs.MaxPartitionSize < new) {
+			for _, hs := range hss {
+				if hs.MaxPartitionSize > 0 && (new == 0 || hs.MaxPartitionSize < new) {
 					new = hs.MaxPartitionSize
 				}
 			}
 			if new != ffReceiver.MaxPartitionSize {
-				log.Println("Setting max-size to", hs.MaxPartitionSize)
+				log.Println("Setting max-size to", new)
 				ffReceiver.MaxPartitionSize = new
 			}
 			time.Sleep(10 * time.Minute)
-			hs.Handshake()
+			for _, hs := range hss {
+				hs.Handshake()
+			}
 		}
 	}()
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschou/go-flowfile"
+)
+
+// Lists of known SHA-256 content hashes, approved ones on the allowlist and
+// known bad ones on the blocklist, are kept in plain text with one hash per
+// line or in the sha256sum format with the file name after the hash.  The
+// files are read again when they change.
+type hashList struct {
+	files []string
+	mu    sync.RWMutex
+	set   map[[32]byte]string // Hash to the name listed with it
+	mod   map[string]time.Time
+}
+
+var (
+	hashAllowFiles = new(string)
+	hashBlockFiles = new(string)
+	hashStrict     = new(bool)
+	hashReload     = new(time.Duration)
+
+	hashAllow, hashBlock *hashList
+)
+
+func hashlist_flags() {
+	hashAllowFiles = flag.String("hash-allow", "", "Files with the SHA-256 hashes of approved content, comma separated, one hash\n"+
+		"per line or in sha256sum format")
+	hashBlockFiles = flag.String("hash-block", "", "Files with the SHA-256 hashes of known bad content to refuse, comma separated,\n"+
+		"these are quarantined when a quarantine directory is set")
+	hashStrict = flag.Bool("hash-strict", false, "Only pass content whose hash is on the allowlist")
+	hashReload = flag.Duration("hash-reload", 30*time.Second, "How often to look for changes to the hash lists")
+}
+
+func hashlist_init() {
+	if *hashStrict && *hashAllowFiles == "" {
+		log.Fatal("An allowlist is needed with -hash-strict")
+	}
+	hashAllow = newHashList(*hashAllowFiles)
+	hashBlock = newHashList(*hashBlockFiles)
+	if !hashLists() {
+		return
+	}
+	for _, l := range []*hashList{hashAllow, hashBlock} {
+		if l != nil {
+			if err := l.load(); err != nil {
+				log.Fatal("Unable to load hash list ", err)
+			}
+		}
+	}
+	if *hashStrict {
+		log.Println("Passing only content on the hash allowlist")
+	}
+
+	go func() {
+		for range time.Tick(*hashReload) {
+			for _, l := range []*hashList{hashAllow, hashBlock} {
+				if l != nil {
+					if err := l.load(); err != nil {
+						log.Println("Unable to reload hash list, keeping the last one,", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// hashLists tells if any content hashes are checked
+func hashLists() bool { return hashAllow != nil || hashBlock != nil }
+
+func newHashList(files string) *hashList {
+	if files == "" {
+		return nil
+	}
+	l := &hashList{mod: make(map[string]time.Time)}
+	for _, file := range strings.Split(files, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			l.files = append(l.files, file)
+		}
+	}
+	return l
+}
+
+// load reads in the lists when any of the files have changed since the last
+// load, the lists are replaced only when all of them could be read.
+func (l *hashList) load() error {
+	changed := false
+	mod := make(map[string]time.Time)
+	for _, file := range l.files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		mod[file] = fi.ModTime()
+		if !fi.ModTime().Equal(l.mod[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	set := make(map[[32]byte]string)
+	for _, file := range l.files {
+		if err := readHashFile(file, set); err != nil {
+			return err
+		}
+		log.Println("Loaded hash list", file)
+	}
+	l.mu.Lock()
+	l.set, l.mod = set, mod
+	l.mu.Unlock()
+	if *verbose {
+		log.Println("  Hash list has", len(set), "entries")
+	}
+	return nil
+}
+
+// readHashFile adds the hashes in a file to the set, skipping blank lines and
+// comments
+func readHashFile(file string, set map[[32]byte]string) error {
+	fh, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	sc := bufio.NewScanner(fh)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// In sha256sum format the name follows, with a * in binary mode
+		var name string
+		if i := strings.IndexAny(line, " \t"); i > 0 {
+			line, name = line[:i], strings.TrimPrefix(strings.TrimSpace(line[i:]), "*")
+		}
+		var sum [32]byte
+		if b, err := hex.DecodeString(line); err != nil || len(b) != len(sum) {
+			log.Printf("  Skipping invalid hash on line %d of %s\n", n, file)
+			continue
+		} else {
+			copy(sum[:], b)
+		}
+		set[sum] = name
+	}
+	return sc.Err()
+}
+
+// lookup tells if a hash is on the list and the name listed with it
+func (l *hashList) lookup(sum [32]byte) (name string, ok bool) {
+	if l == nil {
+		return
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	name, ok = l.set[sum]
+	return
+}
+
+// hashCheck reads the content and applies the lists to its hash, telling if
+// it was on the blocklist, and marks if it was on the allowlist.
+func hashCheck(f *flowfile.File, r io.Reader) (blocked bool, err error) {
+	name := f.Attrs.Get("filename")
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	if listed, ok := hashBlock.lookup(sum); ok {
+		if listed != "" {
+			listed = " as " + listed
+		}
+		return true, rejectf(http.StatusForbidden, "Blocked hash %x of %q%s", sum, name, listed)
+	}
+	if hashAllow != nil {
+		// Content off the list is marked so downstream may tell it apart
+		_, ok := hashAllow.lookup(sum)
+		if !ok && *hashStrict {
+			return false, rejectf(http.StatusForbidden, "Hash %x of %q is not on the allowlist", sum, name)
+		}
+		f.Attrs.Set("hash.allowlisted", strconv.FormatBool(ok))
+	}
+	if *verbose {
+		log.Printf("    Hash %x of %s passed\n", sum, name)
+	}
+	return
+}
+
+// hashCheckFile applies the lists to a received file, quarantining it when
+// blocked
+func hashCheckFile(f *flowfile.File, fp string) error {
+	fh, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	blocked, err := hashCheck(f, fh)
+	if blocked {
+		if fi, serr := fh.Stat(); serr == nil {
+			fh.Seek(0, io.SeekStart)
+			qf := flowfile.New(fh, fi.Size())
+			qf.Attrs = f.Attrs.Clone()
+			quarantineWrite(qf, err.Error())
+		}
+	}
+	return err
+}
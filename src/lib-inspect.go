@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pschou/go-bunit"
+	"github.com/pschou/go-flowfile"
+	"github.com/pschou/go-memdiskbuf"
+)
+
+// Archives are opened and every member is held to the same content policy and
+// malware scan as a FlowFile, going into nested archives up to a depth.  The
+// kind of archive is taken from the magic bytes, never the name.
+
+var (
+	inspectArchives   = new(bool)
+	inspectDepth      = new(int)
+	inspectMaxSize    = new(string)
+	inspectMaxEntries = new(int)
+	inspectMaxRatio   = new(int)
+
+	inspectLimit int64
+)
+
+func inspect_flags() {
+	inspectArchives = flag.Bool("inspect-archives", false, "Open tar, gzip and zip archives and apply the policy and scan to every member")
+	inspectDepth = flag.Int("inspect-depth", 3, "Maximum nesting of archives within archives")
+	inspectMaxSize = flag.String("inspect-max-size", "10GB", "Maximum total uncompressed size of an archive")
+	inspectMaxEntries = flag.Int("inspect-max-entries", 100000, "Maximum number of members in an archive, nested ones included")
+	inspectMaxRatio = flag.Int("inspect-max-ratio", 100, "Maximum ratio of the uncompressed size to the size of an archive")
+}
+
+func inspect_init() {
+	if !*inspectArchives {
+		return
+	}
+	bs, err := bunit.ParseBytes(*inspectMaxSize)
+	if err != nil {
+		log.Fatal("Unable to parse inspect-max-size ", err)
+	}
+	inspectLimit = bs.Int64()
+	log.Println("Inspecting archives up to", *inspectDepth, "deep and", *inspectMaxSize)
+}
+
+// inspecting tells if archives are to be opened
+func inspecting() bool { return *inspectArchives }
+
+// archiveKind determines the kind of archive from the magic bytes
+func archiveKind(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "gz"
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return "tar"
+	case bytes.HasPrefix(head, []byte("7z\xbc\xaf\x27\x1c")):
+		return "7z"
+	case bytes.HasPrefix(head, []byte("Rar!\x1a\x07")):
+		return "rar"
+	}
+	return ""
+}
+
+// An inspection is the walk of one FlowFile and the archives nested in it
+type inspection struct {
+	lim   archiveLimits
+	found string // Signature of malware found in a member
+}
+
+// inspectFlowFile opens the content of a buffered FlowFile when it is an
+// archive, refusing it if any member breaks the rules.
+func inspectFlowFile(f *flowfile.File, buf *memdiskbuf.Buffer) error {
+	name := f.Attrs.Get("filename")
+	if s := f.Attrs.Get("segment.original.filename"); s != "" {
+		name = s
+	}
+	head := make([]byte, 512)
+	n, _ := buf.ReadAt(head, 0)
+	kind := archiveKind(head[:n])
+	if f.Attrs.Get("fragment.index") != "" {
+		if kind != "" || archiveType(name) != "" || strings.HasSuffix(strings.ToLower(name), ".gz") {
+			return rejectf(http.StatusRequestEntityTooLarge, "Segmented archive %q cannot be inspected, send it whole", name)
+		}
+		return nil
+	}
+	if kind == "" {
+		if archiveType(name) != "" {
+			return rejectf(http.StatusUnprocessableEntity, "Unable to inspect archive %q: Not an archive", name)
+		}
+		return nil
+	}
+
+	// Guard against bombs by the total size and the ratio to the archive size
+	max := int64(*inspectMaxRatio) * f.Size
+	if max < 1<<20 {
+		max = 1 << 20
+	}
+	if max > inspectLimit {
+		max = inspectLimit
+	}
+	in := &inspection{lim: archiveLimits{maxBytes: max, maxEntries: *inspectMaxEntries}}
+	err := in.archive(kind, buf, buf.Cap(), name, 1)
+	if in.found != "" {
+		f.Attrs.Set("scan.result", "FOUND")
+		f.Attrs.Set("scan.signature", in.found)
+	}
+	if err == ErrArchiveLimit {
+		return rejectf(http.StatusRequestEntityTooLarge, "Archive %q is over the limits of %v or %d members",
+			name, bunit.NewBytes(max), *inspectMaxEntries)
+	} else if _, ok := err.(*policyError); !ok && err != nil {
+		return rejectf(http.StatusUnprocessableEntity, "Unable to inspect archive %q: %v", name, err)
+	}
+	if err == nil && *verbose {
+		log.Println("    Inspected", kind, "archive", name, "with", in.lim.entries, "members")
+	}
+	if err == nil {
+		f.Attrs.Set("inspect.members", strconv.Itoa(in.lim.entries))
+	}
+	return err
+}
+
+// archive walks the members of an archive at a depth of nesting
+func (in *inspection) archive(kind string, ra io.ReaderAt, size int64, name string, depth int) error {
+	lim := &in.lim
+	if depth > *inspectDepth {
+		return rejectf(http.StatusUnprocessableEntity, "Archive %q is nested deeper than %d", name, *inspectDepth)
+	}
+	switch kind {
+	case "7z", "rar":
+		return rejectf(http.StatusUnsupportedMediaType, "Archive %q is %s which cannot be inspected", name, kind)
+	case "gz":
+		// A gzip holds either a tar or a single file
+		gz, err := gzip.NewReader(io.NewSectionReader(ra, 0, size))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		br := bufio.NewReaderSize(gz, 4096)
+		head, _ := br.Peek(512)
+		if archiveKind(head) == "tar" {
+			return tarWalk(br, lim, func(m *archiveMember, r io.Reader) error {
+				return in.member(m, r, name, depth)
+			})
+		}
+		if lim.entries++; lim.maxEntries > 0 && lim.entries > lim.maxEntries {
+			return ErrArchiveLimit
+		}
+		base := path.Base(name[strings.LastIndex(name, "!")+1:])
+		m := &archiveMember{Name: strings.TrimSuffix(base, path.Ext(base))}
+		if gz.Name != "" {
+			m.Name = gz.Name
+		}
+		return in.member(m, lim.Read(br), name, depth)
+	}
+	return archiveWalk(kind, ra, size, lim, func(m *archiveMember, r io.Reader) error {
+		return in.member(m, r, name, depth)
+	})
+}
+
+// member applies the rules to one member, going into it when it is an archive
+// itself
+func (in *inspection) member(m *archiveMember, r io.Reader, archive string, depth int) error {
+	if m.Dir || m.Symlink {
+		return nil
+	}
+	name := archive + "!" + m.Name
+	if policy != nil {
+		if err := policy.checkName(m.Name); err != nil {
+			return rejectf(err.(*policyError).status, "%s in %q", err, archive)
+		}
+	}
+
+	// The member is held in a buffer to find its type, scan it and open it
+	buf := bufPool.Get().(*memdiskbuf.Buffer)
+	defer func() { buf.Reset(); bufPool.Put(buf) }()
+	buf.Reset()
+	if _, err := io.Copy(buf, r); err != nil {
+		return err
+	}
+	size := buf.Cap()
+	head := make([]byte, 512)
+	n, _ := buf.ReadAt(head, 0)
+	head = head[:n]
+
+	if policy != nil {
+		if err := policy.checkSize(name, size); err != nil {
+			return err
+		}
+		if err := policy.checkMIME(name, detectMIME(head)); err != nil {
+			return err
+		}
+	}
+	if scanning() {
+		buf.Rewind()
+		sig, err := clamScan(buf)
+		if err != nil && *clamdFail != "open" {
+			return rejectf(http.StatusServiceUnavailable, "Unable to scan %q: %v", name, err)
+		} else if sig != "" {
+			in.found = sig
+			return rejectf(http.StatusForbidden, "Found %s in %q", sig, name)
+		}
+	}
+	if *verbose {
+		log.Println("      Member", name, bunit.NewBytes(size))
+	}
+
+	if kind := archiveKind(head); kind != "" {
+		return in.archive(kind, buf, size, name, depth+1)
+	}
+	return nil
+}
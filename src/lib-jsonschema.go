@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A jsonSchema is the part of JSON Schema used to validate what crosses: the
+// type, object, array, string and number keywords, enum and const, the
+// combining keywords and local $ref into definitions or $defs.  A schema
+// using any other keyword is refused, rather than passing content it was
+// meant to stop.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 interface{}            `json:"type"` // A name or a list of names
+	Enum                 []interface{}          `json:"enum"`
+	Const                json.RawMessage        `json:"const"` // Set even when the value is null
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *json.RawMessage       `json:"additionalProperties"` // false or a schema
+	MinProperties        *int                   `json:"minProperties"`
+	MaxProperties        *int                   `json:"maxProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	ExclusiveMinimum     *float64               `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64               `json:"exclusiveMaximum"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+	Not                  *jsonSchema            `json:"not"`
+	Definitions          map[string]*jsonSchema `json:"definitions"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+
+	root        *jsonSchema
+	types       []string
+	constVal    interface{}
+	pattern     *regexp.Regexp
+	noAdditions bool
+	additional  *jsonSchema
+}
+
+// jsonSchemaKeywords are the keywords understood, the ones of the struct and
+// the annotations which do not change what is valid
+var jsonSchemaKeywords = func() map[string]bool {
+	m := map[string]bool{"$schema": true, "$id": true, "id": true, "$comment": true, "title": true,
+		"description": true, "default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true}
+	t := reflect.TypeOf(jsonSchema{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("json"); tag != "" {
+			m[tag] = true
+		}
+	}
+	return m
+}()
+
+// UnmarshalJSON refuses any keyword which is not implemented
+func (s *jsonSchema) UnmarshalJSON(dat []byte) error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(dat, &keys); err != nil {
+		return fmt.Errorf("Schema should be an object: %v", err)
+	}
+	var unsupported []string
+	for k := range keys {
+		if !jsonSchemaKeywords[k] {
+			unsupported = append(unsupported, strconv.Quote(k))
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("Unsupported JSON Schema keywords %s", strings.Join(unsupported, ", "))
+	}
+	type plain jsonSchema
+	return json.Unmarshal(dat, (*plain)(s))
+}
+
+// loadJSONSchema reads in and prepares a schema
+func loadJSONSchema(file string) (*jsonSchema, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &jsonSchema{}
+	if err = json.Unmarshal(dat, s); err != nil {
+		return nil, err
+	}
+	return s, s.prepare(s)
+}
+
+// prepare compiles the patterns and links every sub-schema to the root
+func (s *jsonSchema) prepare(root *jsonSchema) (err error) {
+	if s == nil {
+		return nil
+	}
+	s.root = root
+	switch t := s.Type.(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("Invalid type %v", v)
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return fmt.Errorf("Invalid type %v", t)
+	}
+	for _, t := range s.types {
+		switch t {
+		case "null", "boolean", "string", "object", "array", "number", "integer":
+		default:
+			return fmt.Errorf("Unknown type %q", t)
+		}
+	}
+	if s.Const != nil {
+		if err = json.Unmarshal(s.Const, &s.constVal); err != nil {
+			return
+		}
+	}
+	if s.Pattern != "" {
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return
+		}
+	}
+	if s.AdditionalProperties != nil {
+		var b bool
+		if json.Unmarshal(*s.AdditionalProperties, &b) == nil {
+			s.noAdditions = !b
+		} else {
+			s.additional = &jsonSchema{}
+			if err = json.Unmarshal(*s.AdditionalProperties, s.additional); err != nil {
+				return
+			}
+		}
+	}
+
+	subs := []*jsonSchema{s.additional, s.Items, s.Not}
+	subs = append(subs, s.AllOf...)
+	subs = append(subs, s.AnyOf...)
+	subs = append(subs, s.OneOf...)
+	for _, m := range []map[string]*jsonSchema{s.Properties, s.Definitions, s.Defs} {
+		for _, c := range m {
+			subs = append(subs, c)
+		}
+	}
+	for _, c := range subs {
+		if err = c.prepare(root); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// resolve follows a local $ref
+func (s *jsonSchema) resolve() (*jsonSchema, error) {
+	for i := 0; s.Ref != "" && i < 32; i++ {
+		name := ""
+		switch {
+		case strings.HasPrefix(s.Ref, "#/definitions/"):
+			name = strings.TrimPrefix(s.Ref, "#/definitions/")
+			s = s.root.Definitions[name]
+		case strings.HasPrefix(s.Ref, "#/$defs/"):
+			name = strings.TrimPrefix(s.Ref, "#/$defs/")
+			s = s.root.Defs[name]
+		case s.Ref == "#":
+			s = s.root
+		default:
+			return nil, fmt.Errorf("Unsupported $ref %q", s.Ref)
+		}
+		if s == nil {
+			return nil, fmt.Errorf("Missing definition %q", name)
+		}
+	}
+	return s, nil
+}
+
+// validate checks a decoded value, at is where it is in the document
+func (s *jsonSchema) validate(v interface{}, at string) error {
+	s, err := s.resolve()
+	if err != nil {
+		return err
+	}
+
+	if len(s.types) > 0 {
+		ok := false
+		for _, t := range s.types {
+			if jsonIsType(v, t) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s should be %s", at, strings.Join(s.types, " or "))
+		}
+	}
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			if jsonEqual(v, e) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s is not one of the allowed values", at)
+		}
+	}
+	if s.Const != nil && !jsonEqual(v, s.constVal) {
+		return fmt.Errorf("%s should be %s", at, s.Const)
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := val[name]; !ok {
+				return fmt.Errorf("%s is missing %q", at, name)
+			}
+		}
+		if s.MinProperties != nil && len(val) < *s.MinProperties {
+			return fmt.Errorf("%s has fewer than %d properties", at, *s.MinProperties)
+		}
+		if s.MaxProperties != nil && len(val) > *s.MaxProperties {
+			return fmt.Errorf("%s has more than %d properties", at, *s.MaxProperties)
+		}
+		for name, pv := range val {
+			if ps, ok := s.Properties[name]; ok {
+				if err := ps.validate(pv, at+"."+name); err != nil {
+					return err
+				}
+			} else if s.noAdditions {
+				return fmt.Errorf("%s has unexpected %q", at, name)
+			} else if s.additional != nil {
+				if err := s.additional.validate(pv, at+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(val) < *s.MinItems {
+			return fmt.Errorf("%s has fewer than %d items", at, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(val) > *s.MaxItems {
+			return fmt.Errorf("%s has more than %d items", at, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, iv := range val {
+				if err := s.Items.validate(iv, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(val)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s is shorter than %d", at, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s is longer than %d", at, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			return fmt.Errorf("%s does not match %q", at, s.Pattern)
+		}
+	case json.Number:
+		f, _ := val.Float64()
+		switch {
+		case s.Minimum != nil && f < *s.Minimum:
+			return fmt.Errorf("%s is below %v", at, *s.Minimum)
+		case s.Maximum != nil && f > *s.Maximum:
+			return fmt.Errorf("%s is above %v", at, *s.Maximum)
+		case s.ExclusiveMinimum != nil && f <= *s.ExclusiveMinimum:
+			return fmt.Errorf("%s is not above %v", at, *s.ExclusiveMinimum)
+		case s.ExclusiveMaximum != nil && f >= *s.ExclusiveMaximum:
+			return fmt.Errorf("%s is not below %v", at, *s.ExclusiveMaximum)
+		}
+	}
+
+	for _, c := range s.AllOf {
+		if err := c.validate(v, at); err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		ok := false
+		for _, c := range s.AnyOf {
+			if c.validate(v, at) == nil {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s matches none of anyOf", at)
+		}
+	}
+	if len(s.OneOf) > 0 {
+		n := 0
+		for _, c := range s.OneOf {
+			if c.validate(v, at) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("%s matches %d of oneOf", at, n)
+		}
+	}
+	if s.Not != nil && s.Not.validate(v, at) == nil {
+		return fmt.Errorf("%s matches a schema it must not", at)
+	}
+	return nil
+}
+
+// jsonIsType tells if a decoded value is of a JSON Schema type
+func jsonIsType(v interface{}, t string) bool {
+	switch val := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case map[string]interface{}:
+		return t == "object"
+	case []interface{}:
+		return t == "array"
+	case json.Number:
+		if t == "number" {
+			return true
+		}
+		if t == "integer" {
+			f, err := val.Float64()
+			return err == nil && f == math.Trunc(f)
+		}
+	}
+	return false
+}
+
+// jsonEqual compares a decoded value with one from the schema
+func jsonEqual(a, b interface{}) bool {
+	if n, ok := a.(json.Number); ok {
+		f, _ := n.Float64()
+		bf, ok := b.(float64)
+		return ok && f == bf
+	}
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k := range av {
+			if !jsonEqual(av[k], bv[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testJSONSchema(t *testing.T, schema string) (*jsonSchema, error) {
+	t.Helper()
+	fp := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(fp, []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadJSONSchema(fp)
+}
+
+func TestJSONSchemaLoad(t *testing.T) {
+	tests := []struct {
+		name, schema, err string
+	}{
+		{"annotations", `{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "t", "description": "d", "type": "object"}`, ""},
+		{"patternProperties", `{"type": "object", "patternProperties": {"^x": {"type": "string"}}}`, "patternProperties"},
+		{"if then else", `{"if": {"type": "string"}, "then": {"maxLength": 3}}`, `keywords "if", "then"`},
+		{"uniqueItems", `{"type": "array", "uniqueItems": true}`, "uniqueItems"},
+		{"contains", `{"type": "array", "contains": {"const": 1}}`, "contains"},
+		{"prefixItems", `{"type": "array", "prefixItems": [{"type": "string"}]}`, "prefixItems"},
+		{"dependentRequired", `{"dependentRequired": {"a": ["b"]}}`, "dependentRequired"},
+		{"format", `{"type": "string", "format": "email"}`, "format"},
+		{"nested unsupported", `{"properties": {"a": {"items": {"format": "date"}}}}`, "format"},
+		{"unsupported in additionalProperties", `{"additionalProperties": {"uniqueItems": true}}`, "uniqueItems"},
+		{"unsupported in definitions", `{"$defs": {"a": {"contains": {}}}}`, "contains"},
+		{"tuple items", `{"items": [{"type": "string"}]}`, "should be an object"},
+		{"unknown type", `{"type": "strnig"}`, "strnig"},
+		{"bad pattern", `{"pattern": "("}`, "missing closing"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := testJSONSchema(t, tc.schema)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("Expected an error with %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"required": ["id", "kind"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "integer", "minimum": 1, "exclusiveMaximum": 100},
+			"kind": {"enum": ["a", "b"]},
+			"name": {"type": "string", "minLength": 2, "maxLength": 5, "pattern": "^[a-z]+$"},
+			"tags": {"type": "array", "maxItems": 2, "items": {"$ref": "#/$defs/tag"}},
+			"parent": {"const": null},
+			"extra": {"type": "object", "additionalProperties": {"type": "number"}},
+			"either": {"oneOf": [{"type": "string"}, {"type": "integer"}]},
+			"not": {"not": {"type": "boolean"}}
+		},
+		"$defs": {"tag": {"type": "string", "maxLength": 3}}
+	}`
+	s, err := testJSONSchema(t, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &validation{MaxDepth: 64}
+
+	tests := []struct {
+		name, doc, err string
+	}{
+		{"valid", `{"id": 5, "kind": "a", "name": "abc", "tags": ["x", "yz"], "parent": null}`, ""},
+		{"missing required", `{"id": 5}`, `missing "kind"`},
+		{"unexpected property", `{"id": 5, "kind": "a", "other": 1}`, `unexpected "other"`},
+		{"not an integer", `{"id": 1.5, "kind": "a"}`, "$.id should be integer"},
+		{"below minimum", `{"id": 0, "kind": "a"}`, "below"},
+		{"at exclusive maximum", `{"id": 100, "kind": "a"}`, "not below"},
+		{"not in enum", `{"id": 5, "kind": "c"}`, "allowed values"},
+		{"too short", `{"id": 5, "kind": "a", "name": "a"}`, "shorter"},
+		{"pattern", `{"id": 5, "kind": "a", "name": "AB"}`, "does not match"},
+		{"too many items", `{"id": 5, "kind": "a", "tags": ["a", "b", "c"]}`, "more than 2 items"},
+		{"ref", `{"id": 5, "kind": "a", "tags": ["long"]}`, "$.tags[0] is longer"},
+		{"const null", `{"id": 5, "kind": "a", "parent": 0}`, "should be null"},
+		{"additional schema", `{"id": 5, "kind": "a", "extra": {"x": "y"}}`, "$.extra.x should be number"},
+		{"oneOf", `{"id": 5, "kind": "a", "either": true}`, "matches 0 of oneOf"},
+		{"not", `{"id": 5, "kind": "a", "not": false}`, "must not"},
+		{"duplicate key", `{"id": 5, "id": 6, "kind": "a"}`, "Duplicate key"},
+		{"trailing data", `{"id": 5, "kind": "a"} {}`, "Data after"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := v.checkJSON(strings.NewReader(tc.doc), s)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("Expected an error with %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestJSONDepth(t *testing.T) {
+	v := &validation{MaxDepth: 3}
+	if err := v.checkJSON(strings.NewReader(`[[[1]]]`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.checkJSON(strings.NewReader(`[[[[1]]]]`), nil); err == nil {
+		t.Fatal("Expected the depth to be refused")
+	}
+}
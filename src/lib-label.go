@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschou/go-flowfile"
+)
+
+// Security labels are carried as a classification and a releasability list in
+// the attributes.  Labels form a lattice where one label is dominated by
+// another when the classification is no higher and the releasability is no
+// narrower, as content released to more nations may go where fewer are
+// served.  Every FlowFile must be dominated by the level of the diode and,
+// when client levels are given, by the level of the client certificate.
+type labelPolicy struct {
+	ClassificationAttribute string         `json:"classificationAttribute"`
+	ReleasabilityAttribute  string         `json:"releasabilityAttribute"`
+	Levels                  []string       `json:"levels"` // Classifications from lowest to highest
+	Max                     labelLevel     `json:"max"`
+	Clients                 []*labelClient `json:"clients"`
+
+	rank map[string]int
+}
+
+// A labelLevel is a point in the lattice
+type labelLevel struct {
+	Classification string   `json:"classification"`
+	Releasability  []string `json:"releasability"`
+}
+
+// A labelClient ties a level to the clients matching a certificate subject
+type labelClient struct {
+	Subject string `json:"subject"`
+	labelLevel
+
+	subject *regexp.Regexp
+}
+
+// An auditRecord is one line of the audit log
+type auditRecord struct {
+	Time           time.Time `json:"time"`
+	Decision       string    `json:"decision"`
+	Client         string    `json:"client"`
+	Remote         string    `json:"remote"`
+	Path           string    `json:"path"`
+	Filename       string    `json:"filename"`
+	UUID           string    `json:"uuid,omitempty"`
+	Classification string    `json:"classification"`
+	Releasability  string    `json:"releasability"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+var (
+	labelsFile = new(string)
+	auditFile  = new(string)
+	labels     *labelPolicy
+	auditLock  sync.Mutex
+	auditFH    *os.File
+)
+
+func label_flags() {
+	labelsFile = flag.String("labels", "", "JSON file with the security label lattice, the level of this diode and of the\n"+
+		"client certificates.  FlowFiles with missing, invalid or higher labels are rejected.")
+	auditFile = flag.String("audit", "", "File to append the label decisions to as JSON lines (default is the log)")
+}
+
+// loadLabels reads in the label policy and opens the audit log
+func loadLabels() {
+	if *labelsFile == "" {
+		return
+	}
+	dat, err := os.ReadFile(*labelsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	labels = &labelPolicy{}
+	if err = json.Unmarshal(dat, labels); err != nil {
+		log.Fatal("Unable to parse labels file ", err)
+	}
+	fmt.Println("Loading security labels from file", *labelsFile)
+	if labels.ClassificationAttribute == "" {
+		labels.ClassificationAttribute = "security.classification"
+	}
+	if labels.ReleasabilityAttribute == "" {
+		labels.ReleasabilityAttribute = "security.releasability"
+	}
+	if len(labels.Levels) == 0 {
+		log.Fatal("No classification levels in labels file")
+	}
+	labels.rank = make(map[string]int)
+	for i, l := range labels.Levels {
+		if _, ok := labels.rank[normLabel(l)]; ok {
+			log.Fatal("Duplicate classification level ", l)
+		}
+		labels.rank[normLabel(l)] = i
+	}
+	labels.Max.normalize()
+	if err = labels.valid(labels.Max); err != nil {
+		log.Fatal("Invalid max level ", err)
+	}
+	for _, c := range labels.Clients {
+		if c.subject, err = compileGlob(c.Subject); err != nil {
+			log.Fatal("Invalid client subject ", c.Subject, err)
+		}
+		c.normalize()
+		if err = labels.valid(c.labelLevel); err != nil {
+			log.Fatal("Invalid level for client ", c.Subject, " ", err)
+		}
+	}
+	if *verbose {
+		log.Printf("  Levels %q, max %s rel %q, %d client levels\n", labels.Levels,
+			labels.Max.Classification, labels.Max.Releasability, len(labels.Clients))
+	}
+
+	if *auditFile != "" {
+		if auditFH, err = os.OpenFile(*auditFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640); err != nil {
+			log.Fatal("Unable to open audit log ", err)
+		}
+		log.Println("Auditing label decisions to", *auditFile)
+	}
+}
+
+// normLabel puts a marking in the one form used for comparisons
+func normLabel(s string) string { return strings.ToUpper(strings.TrimSpace(s)) }
+
+// normalize puts the markings of a level in the form used for comparisons
+func (l *labelLevel) normalize() {
+	l.Classification = normLabel(l.Classification)
+	for i, rel := range l.Releasability {
+		l.Releasability[i] = normLabel(rel)
+	}
+}
+
+// rankOf finds the position of a classification in the levels
+func (p *labelPolicy) rankOf(classification string) (int, error) {
+	r, ok := p.rank[normLabel(classification)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown classification %q", classification)
+	}
+	return r, nil
+}
+
+// valid makes sure the classification of a level is known
+func (p *labelPolicy) valid(l labelLevel) error {
+	_, err := p.rankOf(l.Classification)
+	return err
+}
+
+// dominates tells if level m dominates level l, or else why not
+func (p *labelPolicy) dominates(m, l labelLevel) error {
+	lr, err := p.rankOf(l.Classification)
+	if err != nil {
+		return err
+	}
+	mr, err := p.rankOf(m.Classification)
+	if err != nil {
+		return err
+	}
+	if lr > mr {
+		return fmt.Errorf("%s is above %s", l.Classification, m.Classification)
+	}
+	for _, nation := range m.Releasability {
+		found := false
+		for _, rel := range l.Releasability {
+			if rel == nation {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Not releasable to %s", nation)
+		}
+	}
+	return nil
+}
+
+// label reads the level of a FlowFile from its attributes
+func (p *labelPolicy) label(attrs flowfile.Attributes) (l labelLevel, err error) {
+	l.Classification = normLabel(attrs.Get(p.ClassificationAttribute))
+	if l.Classification == "" {
+		return l, fmt.Errorf("Missing %s", p.ClassificationAttribute)
+	}
+	if err = p.valid(l); err != nil {
+		return
+	}
+	rel := attrs.Get(p.ReleasabilityAttribute)
+	list := strings.TrimPrefix(normLabel(rel), "REL TO")
+	for _, nation := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' || r == '/' }) {
+		if !isLabelWord(nation) {
+			return l, fmt.Errorf("Invalid %s %q", p.ReleasabilityAttribute, rel)
+		}
+		l.Releasability = append(l.Releasability, nation)
+	}
+	if len(l.Releasability) == 0 && len(p.Max.Releasability) > 0 {
+		return l, fmt.Errorf("Missing %s", p.ReleasabilityAttribute)
+	}
+	sort.Strings(l.Releasability)
+	return
+}
+
+// check applies the lattice to a FlowFile, auditing the decision
+func (p *labelPolicy) check(f *flowfile.File, r *http.Request) (err error) {
+	rec := auditRecord{
+		Time:     time.Now().UTC(),
+		Client:   clientKey(r),
+		Remote:   r.RemoteAddr,
+		Path:     f.Attrs.Get("path"),
+		Filename: f.Attrs.Get("filename"),
+		UUID:     f.Attrs.Get("uuid"),
+	}
+	defer func() {
+		rec.Decision = "allow"
+		if err != nil {
+			rec.Decision, rec.Reason = "deny", err.Error()
+			err = rejectf(http.StatusForbidden, "Label denied for %q: %v", rec.Filename, err)
+		}
+		audit(rec)
+	}()
+
+	var l labelLevel
+	l, err = p.label(f.Attrs)
+	rec.Classification, rec.Releasability = l.Classification, strings.Join(l.Releasability, ",")
+	if err != nil {
+		return
+	}
+	if err = p.dominates(p.Max, l); err != nil {
+		return
+	}
+	if len(p.Clients) == 0 {
+		return
+	}
+	dn := peerSubject(r)
+	for _, c := range p.Clients {
+		if c.subject.MatchString(dn) {
+			if err = p.dominates(c.labelLevel, l); err != nil {
+				err = fmt.Errorf("%v for client", err)
+			}
+			return
+		}
+	}
+	return fmt.Errorf("No level for client %q", dn)
+}
+
+// audit writes out a decision
+func audit(rec auditRecord) {
+	dat, _ := json.Marshal(rec)
+	if auditFH == nil {
+		log.Println("  Audit", string(dat))
+		return
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if _, err := auditFH.Write(append(dat, '\n')); err != nil {
+		log.Println("Unable to write audit log", err)
+	}
+}
+
+// isLabelWord allows the letters, digits, dashes and underscores of a
+// releasability marking
+func isLabelWord(s string) bool {
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return s != ""
+}
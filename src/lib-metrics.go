@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,6 +21,12 @@ var (
 	metricsTarget    string
 	metricsFrequency time.Duration
 	metricsBuilder   = &strings.Builder{}
+
+	// Additional gauges which a utility reports along with the transfer metrics
+	metricsGauges = make(map[string]func() int64)
+
+	// Additional sets of metrics, called with the host and action labels
+	metricsSources []func(host, action string) string
 )
 
 // This function periodically sends metrics to the prom collector
@@ -54,6 +62,18 @@ func send_metrics(proc string, send func(*flowfile.File), metrics *flowfile.Metr
 			//cur.Write([]byte("\n# Local metrics\n"))
 			hn, _ := os.Hostname()
 			cur.Write([]byte(metrics.String("host", hn, "action", proc)))
+			var gauges []string
+			for name := range metricsGauges {
+				gauges = append(gauges, name)
+			}
+			sort.Strings(gauges)
+			tm := time.Now().UnixMilli()
+			for _, name := range gauges {
+				fmt.Fprintf(cur, "%s{host=%q,action=%q} %d %d\n", name, hn, proc, metricsGauges[name](), tm)
+			}
+			for _, src := range metricsSources {
+				cur.WriteString(src(hn, proc))
+			}
 			str := cur.String()
 			rdr := strings.NewReader(str)
 			ff := flowfile.New(rdr, int64(len(str)))
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pschou/go-bunit"
+	"github.com/pschou/go-flowfile"
+)
+
+// A contentPolicy decides what may cross the boundary.  The lists are
+// optional, when an allow list is given only what is on it may pass.
+type contentPolicy struct {
+	AllowExtensions     []string            `json:"allowExtensions"`
+	DenyExtensions      []string            `json:"denyExtensions"`
+	AllowMIME           []string            `json:"allowMime"` // Globs like "text/*"
+	DenyMIME            []string            `json:"denyMime"`
+	MaxSize             string              `json:"maxSize"`
+	ForbiddenAttributes map[string][]string `json:"forbiddenAttributes"` // Globs of values by attribute name
+
+	maxSize   int64
+	forbidden map[string][]*regexp.Regexp
+}
+
+// A policyError refuses a FlowFile with the HTTP status to give the sender
+type policyError struct {
+	status     int
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *policyError) Error() string { return e.reason }
+
+func rejectf(status int, format string, a ...interface{}) error {
+	return &policyError{status: status, reason: fmt.Sprintf(format, a...)}
+}
+
+// retryf refuses a FlowFile for now, telling the sender when to try again
+func retryf(after time.Duration, format string, a ...interface{}) error {
+	return &policyError{status: http.StatusTooManyRequests, reason: fmt.Sprintf(format, a...), retryAfter: after}
+}
+
+// replyError answers the sender with the status of a policyError, or with an
+// internal server error for anything else.
+func replyError(w http.ResponseWriter, err error) {
+	var pe *policyError
+	if errors.As(err, &pe) {
+		if pe.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((pe.retryAfter+time.Second-1)/time.Second)))
+		}
+		http.Error(w, pe.reason, pe.status)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+var (
+	policyFile = new(string)
+	policy     *contentPolicy
+)
+
+func policy_flags() {
+	policyFile = flag.String("policy", "", "JSON file with the content policy: allowed and denied extensions and MIME types,\n"+
+		"maximum size and forbidden attribute values.  FlowFiles violating it are rejected.")
+}
+
+func loadPolicy() {
+	if *policyFile == "" {
+		return
+	}
+	dat, err := os.ReadFile(*policyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy = &contentPolicy{}
+	if err = json.Unmarshal(dat, policy); err != nil {
+		log.Fatal("Unable to parse policy file ", err)
+	}
+	fmt.Println("Loading content policy from file", *policyFile)
+	if policy.MaxSize != "" {
+		bs, err := bunit.ParseBytes(policy.MaxSize)
+		if err != nil {
+			log.Fatal("Unable to parse policy maxSize ", err)
+		}
+		policy.maxSize = bs.Int64()
+	}
+	policy.forbidden = make(map[string][]*regexp.Regexp)
+	for name, patterns := range policy.ForbiddenAttributes {
+		for _, pattern := range patterns {
+			re, err := compileGlob(pattern)
+			if err != nil {
+				log.Fatal("Invalid forbidden value for ", name, err)
+			}
+			policy.forbidden[name] = append(policy.forbidden[name], re)
+		}
+	}
+	if *verbose {
+		log.Printf("  Extensions allowed %q denied %q\n", policy.AllowExtensions, policy.DenyExtensions)
+		log.Printf("  MIME types allowed %q denied %q\n", policy.AllowMIME, policy.DenyMIME)
+		log.Printf("  Max size %q, %d forbidden attributes\n", policy.MaxSize, len(policy.forbidden))
+	}
+}
+
+// checkName applies the extension lists to a file name
+func (p *contentPolicy) checkName(name string) error {
+	lower := strings.ToLower(name)
+	for _, ext := range p.DenyExtensions {
+		if strings.HasSuffix(lower, strings.ToLower(ext)) {
+			return rejectf(http.StatusUnsupportedMediaType, "Denied extension %q on %q", ext, name)
+		}
+	}
+	if len(p.AllowExtensions) == 0 {
+		return nil
+	}
+	for _, ext := range p.AllowExtensions {
+		if strings.HasSuffix(lower, strings.ToLower(ext)) {
+			return nil
+		}
+	}
+	return rejectf(http.StatusUnsupportedMediaType, "Extension not allowed on %q", name)
+}
+
+// checkSize applies the maximum size
+func (p *contentPolicy) checkSize(name string, size int64) error {
+	if p.maxSize > 0 && size > p.maxSize {
+		return rejectf(http.StatusRequestEntityTooLarge, "Size %v of %q is over the limit of %v", bunit.NewBytes(size), name, bunit.NewBytes(p.maxSize))
+	}
+	return nil
+}
+
+// checkMIME applies the MIME type lists to a type detected from the content
+func (p *contentPolicy) checkMIME(name, mime string) error {
+	for _, pattern := range p.DenyMIME {
+		if ok, _ := path.Match(pattern, mime); ok {
+			return rejectf(http.StatusUnsupportedMediaType, "Denied content type %q in %q", mime, name)
+		}
+	}
+	if len(p.AllowMIME) == 0 {
+		return nil
+	}
+	for _, pattern := range p.AllowMIME {
+		if ok, _ := path.Match(pattern, mime); ok {
+			return nil
+		}
+	}
+	return rejectf(http.StatusUnsupportedMediaType, "Content type %q not allowed in %q", mime, name)
+}
+
+// checkAttrs looks for forbidden attribute values
+func (p *contentPolicy) checkAttrs(name string, attrs flowfile.Attributes) error {
+	for attr, res := range p.forbidden {
+		val := attrs.Get(attr)
+		for _, re := range res {
+			if re.MatchString(val) {
+				return rejectf(http.StatusForbidden, "Forbidden value %q for %s on %q", val, attr, name)
+			}
+		}
+	}
+	return nil
+}
+
+// needsContent tells if the payload has to be looked at
+func (p *contentPolicy) needsContent() bool {
+	return len(p.AllowMIME) > 0 || len(p.DenyMIME) > 0
+}
+
+// checkFlowFile applies the policy to a FlowFile.  When the content type has
+// to be checked the first bytes are read and f is replaced with a FlowFile
+// which replays them, the original is returned for verifying the checksum.
+func (p *contentPolicy) checkFlowFile(f *flowfile.File) (orig *flowfile.File, err error) {
+	orig = f
+	name := f.Attrs.Get("filename")
+	index, original, size, err := fragmentInfo(f)
+	if err != nil {
+		return
+	}
+
+	// The file is saved under its own name and later joined under the
+	// original, both have to pass
+	if err = p.checkName(name); err != nil {
+		return
+	}
+	if original != "" && original != name {
+		if err = p.checkName(original); err != nil {
+			return
+		}
+	}
+	if err = p.checkSize(name, size); err != nil {
+		return
+	}
+	if err = p.checkAttrs(name, f.Attrs); err != nil {
+		return
+	}
+
+	// Only the start of a file carries the magic bytes
+	if !p.needsContent() || f.Size == 0 || index > 1 {
+		return
+	}
+	head := make([]byte, 512)
+	n, rerr := io.ReadFull(f, head)
+	if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+		return orig, rerr
+	}
+	head = head[:n]
+	if err = p.checkMIME(name, detectMIME(head)); err != nil {
+		return
+	}
+
+	orig = new(flowfile.File)
+	*orig = *f
+	replay := flowfile.New(io.MultiReader(bytes.NewReader(head), orig), f.Size)
+	replay.Attrs = f.Attrs
+	*f = *replay
+	return
+}
+
+// fragmentInfo reads what a FlowFile claims about the file it is a segment
+// of, the index is zero for a whole file.  Only a fragment may name an
+// original file, and the size is never less than what was sent.
+func fragmentInfo(f *flowfile.File) (index int, original string, size int64, err error) {
+	size = f.Size
+	id := f.Attrs.Get("fragment.index")
+	if id == "" {
+		return
+	}
+	if index, err = strconv.Atoi(id); err != nil || index < 1 {
+		return 0, "", size, rejectf(http.StatusBadRequest, "Invalid fragment.index %q on %q", id, f.Attrs.Get("filename"))
+	}
+	original = f.Attrs.Get("segment.original.filename")
+	if n, perr := strconv.ParseInt(f.Attrs.Get("segment.original.size"), 10, 64); perr == nil && n > size {
+		size = n
+	}
+	return
+}
+
+// detectMIME determines the content type from the magic bytes, adding the
+// executable formats which the standard library does not know about.
+func detectMIME(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(head, []byte{0xca, 0xfe, 0xba, 0xbe}):
+		return "application/java-vm"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-shellscript"
+	}
+	mime := http.DetectContentType(head)
+	if i := strings.Index(mime, ";"); i > 0 {
+		mime = mime[:i]
+	}
+	return mime
+}
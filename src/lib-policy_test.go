@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pschou/go-flowfile"
+)
+
+func testFlowFile(body string, attrs ...string) *flowfile.File {
+	f := flowfile.New(strings.NewReader(body), int64(len(body)))
+	for i := 0; i+1 < len(attrs); i += 2 {
+		f.Attrs.Set(attrs[i], attrs[i+1])
+	}
+	return f
+}
+
+func TestCheckFlowFile(t *testing.T) {
+	p := &contentPolicy{AllowExtensions: []string{".txt"}, DenyMIME: []string{"application/x-msdownload"}, maxSize: 100}
+	exe := "MZ" + strings.Repeat("\x00", 60)
+	big := strings.Repeat("x", 200)
+
+	tests := []struct {
+		name   string
+		body   string
+		attrs  []string
+		status int // Zero when allowed
+	}{
+		{"allowed", "hello", []string{"filename", "a.txt"}, 0},
+		{"extension", "hello", []string{"filename", "a.exe"}, http.StatusUnsupportedMediaType},
+		{"original name on a whole file", "hello", []string{"filename", "evil.exe", "segment.original.filename", "a.txt"}, http.StatusUnsupportedMediaType},
+		{"original name on a fragment", "hello", []string{"filename", "evil.exe", "fragment.index", "2", "segment.original.filename", "a.txt"}, http.StatusUnsupportedMediaType},
+		{"fragment with a bad original name", "hello", []string{"filename", "a.txt", "fragment.index", "2", "segment.original.filename", "a.exe"}, http.StatusUnsupportedMediaType},
+		{"original size on a whole file", big, []string{"filename", "a.txt", "segment.original.size", "1"}, http.StatusRequestEntityTooLarge},
+		{"original size below the fragment", big, []string{"filename", "a.txt", "fragment.index", "2", "segment.original.size", "1"}, http.StatusRequestEntityTooLarge},
+		{"original size of a fragment", "hello", []string{"filename", "a.txt", "fragment.index", "2", "segment.original.size", "1000"}, http.StatusRequestEntityTooLarge},
+		{"magic", exe, []string{"filename", "a.txt"}, http.StatusUnsupportedMediaType},
+		{"magic of the first fragment", exe, []string{"filename", "a.txt", "fragment.index", "1"}, http.StatusUnsupportedMediaType},
+		{"magic of a padded first fragment", exe, []string{"filename", "a.txt", "fragment.index", "01"}, http.StatusUnsupportedMediaType},
+		{"magic of a signed first fragment", exe, []string{"filename", "a.txt", "fragment.index", "+1"}, http.StatusUnsupportedMediaType},
+		{"magic of a later fragment", exe, []string{"filename", "a.txt", "fragment.index", "2"}, 0},
+		{"invalid index", "hello", []string{"filename", "a.txt", "fragment.index", "one"}, http.StatusBadRequest},
+		{"zero index", "hello", []string{"filename", "a.txt", "fragment.index", "0"}, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := testFlowFile(tc.body, tc.attrs...)
+			_, err := p.checkFlowFile(f)
+			if tc.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The content read for the check is replayed
+				if dat, _ := io.ReadAll(f); string(dat) != tc.body {
+					t.Fatal("Content not replayed")
+				}
+				return
+			}
+			var pe *policyError
+			if !errors.As(err, &pe) || pe.status != tc.status {
+				t.Fatalf("Expected status %d, got %v", tc.status, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/pschou/go-flowfile"
+)
+
+// FlowFiles which are refused for their content may be kept on the side, with
+// the reason, for an analyst to look at.
+
+var (
+	quarantineDir   = new(string)
+	quarantineCount int64
+)
+
+func quarantine_flags() {
+	quarantineDir = flag.String("quarantine", "", "Directory in which to keep FlowFiles refused for their content, default is\n"+
+		"to only refuse them")
+}
+
+// quarantineWrite saves the FlowFile with the reason into the quarantine
+// directory, when one is set, reading the content through to the end.
+func quarantineWrite(f *flowfile.File, reason string) {
+	if *quarantineDir == "" {
+		return
+	}
+	os.MkdirAll(*quarantineDir, 0750)
+	name := fmt.Sprintf("%s-%d.ff", time.Now().Format("20060102T150405"), atomic.AddInt64(&quarantineCount, 1))
+	fp := path.Join(*quarantineDir, name)
+	f.Attrs.Set("quarantine.reason", reason)
+	f.Attrs.Set("quarantine.time", time.Now().UTC().Format(time.RFC3339))
+
+	fh, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err == nil {
+		_, err = flowfile.NewWriter(fh).Write(f)
+		fh.Close()
+	}
+	if err != nil {
+		log.Println("  Unable to quarantine", f.Attrs.Get("filename"), err)
+		os.Remove(fp)
+		return
+	}
+	log.Println("  Quarantined", f.Attrs.Get("filename"), "as", fp)
+}
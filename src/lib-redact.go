@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pschou/go-bunit"
+	"github.com/pschou/go-flowfile"
+	"github.com/pschou/go-memdiskbuf"
+)
+
+// Redaction rewrites text payloads line by line, replacing what the rules
+// match, so identifiers are stripped before they leave.  The FlowFiles are
+// chosen by attribute or MIME type, and the content must also look like text,
+// binary content is passed through unchanged.  Only whole lines are matched,
+// content with a line longer than the limit is refused rather than letting a
+// match split across pieces through.
+type redaction struct {
+	Attributes map[string][]string `json:"attributes"` // Attribute to value globs choosing FlowFiles
+	MIME       []string            `json:"mime"`       // MIME type patterns choosing FlowFiles
+	Rules      []*redactRule       `json:"rules"`
+	MaxLine    string              `json:"maxLine"` // Longest line which can be redacted, default 1MB
+	Quarantine bool                `json:"quarantine"`
+
+	attrs   map[string][]*regexp.Regexp
+	maxLine int
+}
+
+// A redactRule replaces every match of a pattern, the replacement may refer
+// to groups as $1 or ${name}
+type redactRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+var (
+	redactFile = new(string)
+	redact     *redaction
+)
+
+func redact_flags() {
+	redactFile = flag.String("redact", "", "JSON file with the redaction rules for text payloads and the attributes or\n"+
+		"MIME types choosing which FlowFiles are redacted.")
+}
+
+// loadRedaction reads in and compiles the redaction rules
+func loadRedaction() {
+	if *redactFile == "" {
+		return
+	}
+	dat, err := os.ReadFile(*redactFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	redact = &redaction{}
+	if err = json.Unmarshal(dat, redact); err != nil {
+		log.Fatal("Unable to parse redact file ", err)
+	}
+	fmt.Println("Loading redaction rules from file", *redactFile)
+	if len(redact.Rules) == 0 {
+		log.Fatal("No rules in redact file")
+	}
+	if redact.MaxLine == "" {
+		redact.MaxLine = "1MB"
+	}
+	if bs, err := bunit.ParseBytes(redact.MaxLine); err != nil {
+		log.Fatal("Unable to parse redact maxLine ", err)
+	} else if redact.maxLine = int(bs.Int64()); redact.maxLine < 16 {
+		log.Fatal("The redact maxLine is too small")
+	}
+	for i, rule := range redact.Rules {
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i + 1)
+		}
+		if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+			log.Fatal("Invalid redact pattern for ", rule.Name, " ", err)
+		}
+	}
+	redact.attrs = make(map[string][]*regexp.Regexp)
+	for name, patterns := range redact.Attributes {
+		for _, pattern := range patterns {
+			re, err := compileGlob(pattern)
+			if err != nil {
+				log.Fatal("Invalid redact value for ", name, err)
+			}
+			redact.attrs[name] = append(redact.attrs[name], re)
+		}
+	}
+	if *verbose {
+		log.Printf("  %d rules for MIME types %q and %d attributes\n", len(redact.Rules), redact.MIME, len(redact.attrs))
+	}
+}
+
+// selected tells if a FlowFile is chosen for redaction
+func (p *redaction) selected(attrs flowfile.Attributes) bool {
+	for name, res := range p.attrs {
+		val := attrs.Get(name)
+		for _, re := range res {
+			if re.MatchString(val) {
+				return true
+			}
+		}
+	}
+	mime := strings.ToLower(attrs.Get("mime.type"))
+	if i := strings.Index(mime, ";"); i > 0 {
+		mime = strings.TrimSpace(mime[:i])
+	}
+	for _, pattern := range p.MIME {
+		if ok, _ := path.Match(pattern, mime); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply redacts the content held in buf into out, returning a FlowFile which
+// replays the rewritten content with the checksum recomputed and the count of
+// redactions recorded.  FlowFiles not chosen or not text are returned as is.
+func (p *redaction) apply(f *flowfile.File, buf, out *memdiskbuf.Buffer) (*flowfile.File, error) {
+	name := f.Attrs.Get("filename")
+	if !p.selected(f.Attrs) || f.Size == 0 {
+		return f, nil
+	}
+	if f.Attrs.Get("fragment.index") != "" {
+		return nil, rejectf(http.StatusRequestEntityTooLarge, "Segmented %q cannot be redacted, send it whole", name)
+	}
+	head := make([]byte, 512)
+	n, _ := buf.ReadAt(head, 0)
+	head = head[:n]
+	if mime := detectMIME(head); bytes.IndexByte(head, 0) >= 0 ||
+		!(strings.HasPrefix(mime, "text/") || mime == "application/json" || mime == "application/xml") {
+		if *verbose {
+			log.Println("    Not redacting", name, "with content type", mime)
+		}
+		return f, nil
+	}
+
+	// The new checksum is of the same type as the one sent
+	out.Reset()
+	var w io.Writer = out
+	h := f.Attrs.NewChecksumHash()
+	if h != nil {
+		w = io.MultiWriter(out, h)
+	}
+	counts := make([]int, len(p.Rules))
+	total := 0
+	br := bufio.NewReaderSize(buf, p.maxLine)
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			buf.Rewind()
+			err = rejectf(http.StatusUnprocessableEntity, "Line over %v in %q cannot be redacted", bunit.NewBytes(int64(p.maxLine)), name)
+			if p.Quarantine {
+				quarantineWrite(f, err.Error())
+			}
+			return nil, err
+		}
+		if len(line) > 0 {
+			for i, rule := range p.Rules {
+				if c := len(rule.re.FindAllIndex(line, -1)); c > 0 {
+					counts[i], total = counts[i]+c, total+c
+					line = rule.re.ReplaceAll(line, []byte(rule.Replace))
+				}
+			}
+			if _, werr := w.Write(line); werr != nil {
+				return nil, werr
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	ff := flowfile.New(struct{ io.Reader }{out}, out.Cap())
+	ff.Attrs = f.Attrs
+	if h != nil {
+		ff.Attrs.Set("redact.original.checksum", f.Attrs.Get("checksum"))
+		ff.Attrs.Set("checksum", fmt.Sprintf("%0x", h.Sum(nil)))
+	} else if ff.Attrs.Unset("checksum") {
+		ff.Attrs.Unset("checksumType")
+	}
+	ff.Attrs.Set("redact.count", strconv.Itoa(total))
+	for i, rule := range p.Rules {
+		if counts[i] > 0 {
+			ff.Attrs.Set("redact."+rule.Name+".count", strconv.Itoa(counts[i]))
+		}
+	}
+	if *verbose {
+		log.Println("    Redacted", total, "matches in", name)
+	}
+	return ff, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/pschou/go-flowfile"
+	"github.com/pschou/go-memdiskbuf"
+)
+
+func testRedaction(maxLine int) *redaction {
+	return &redaction{
+		MIME: []string{"text/*"},
+		Rules: []*redactRule{
+			{Name: "ssn", Replace: "XXX-XX-XXXX", re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+			{Name: "email", Replace: "${user}@example.com", re: regexp.MustCompile(`(?P<user>\w+)@[\w.]+\.mil`)},
+		},
+		maxLine: maxLine,
+	}
+}
+
+// testRedact runs content through the rules, the buffers are kept small so
+// the content also goes through the disk
+func testRedact(t *testing.T, p *redaction, content string) (*flowfile.File, string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	buf := memdiskbuf.NewBuffer(filepath.Join(dir, "buf"), 4<<10, 16<<10)
+	out := memdiskbuf.NewBuffer(filepath.Join(dir, "out"), 4<<10, 16<<10)
+	t.Cleanup(func() { buf.Reset(); out.Reset() })
+	if _, err := io.WriteString(buf, content); err != nil {
+		t.Fatal(err)
+	}
+	f := flowfile.New(struct{ io.Reader }{buf}, int64(len(content)))
+	f.Attrs.Set("filename", "test.txt")
+	f.Attrs.Set("mime.type", "text/plain")
+	f.Attrs.Set("checksumType", "SHA256")
+	f.Attrs.Set("checksum", fmt.Sprintf("%x", sha256.Sum256([]byte(content))))
+
+	ff, err := p.apply(f, buf, out)
+	if err != nil {
+		return nil, "", err
+	}
+	dat, err := io.ReadAll(ff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ff, string(dat), nil
+}
+
+func TestRedactChunkBoundary(t *testing.T) {
+	// Place a match across every power of two boundary a reader might use
+	var sb strings.Builder
+	want := 0
+	for _, at := range []int{4 << 10, 16 << 10, 64 << 10, 128 << 10} {
+		sb.WriteString(strings.Repeat("a", at-sb.Len()-5))
+		sb.WriteString(" 123-45-6789 and jdoe@mail.army.mil ")
+		want += 2
+	}
+	sb.WriteString("\nsecond line 987-65-4321\n")
+	want++
+	content := sb.String()
+
+	ff, dat, err := testRedact(t, testRedaction(1<<20), content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{"123-45-6789", "987-65-4321", "mail.army.mil"} {
+		if strings.Contains(dat, leak) {
+			t.Fatalf("Found %q after redaction", leak)
+		}
+	}
+	if got := ff.Attrs.Get("redact.count"); got != fmt.Sprint(want) {
+		t.Fatalf("redact.count is %s, want %d", got, want)
+	}
+	if got := strings.Count(dat, "jdoe@example.com"); got != 4 {
+		t.Fatalf("Replaced %d emails with the group, want 4", got)
+	}
+	if ff.Attrs.Get("checksum") != fmt.Sprintf("%x", sha256.Sum256([]byte(dat))) {
+		t.Fatal("Checksum is not of the redacted content")
+	}
+	if ff.Attrs.Get("redact.original.checksum") != fmt.Sprintf("%x", sha256.Sum256([]byte(content))) {
+		t.Fatal("Original checksum not kept")
+	}
+	if ff.Size != int64(len(dat)) {
+		t.Fatalf("Size is %d for %d bytes", ff.Size, len(dat))
+	}
+}
+
+func TestRedactLongLine(t *testing.T) {
+	// A match straddling the end of the reader would be missed, so the line
+	// is refused instead
+	content := strings.Repeat("a", 1020) + " 123-45-6789\n"
+	dir := t.TempDir()
+	oldDir := *quarantineDir
+	*quarantineDir = dir
+	defer func() { *quarantineDir = oldDir }()
+
+	p := testRedaction(1 << 10)
+	p.Quarantine = true
+	_, _, err := testRedact(t, p, content)
+	pe, ok := err.(*policyError)
+	if !ok || pe.status != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected the line to be refused, got %v", err)
+	}
+	list, _ := os.ReadDir(dir)
+	if len(list) != 1 {
+		t.Fatalf("Expected one quarantined FlowFile, found %d", len(list))
+	}
+
+	// The same content fits with a longer limit
+	if _, dat, err := testRedact(t, testRedaction(2<<10), content); err != nil || strings.Contains(dat, "6789") {
+		t.Fatalf("Expected to be redacted, got %v", err)
+	}
+}
+
+func TestRedactNotText(t *testing.T) {
+	content := "\x00\x01\x02 123-45-6789"
+	ff, dat, err := testRedact(t, testRedaction(1<<20), content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dat != content || ff.Attrs.Get("redact.count") != "" {
+		t.Fatal("Binary content was changed")
+	}
+}
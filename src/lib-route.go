@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschou/go-flowfile"
+)
+
+// A route sends FlowFiles with matching attributes to a downstream URL.  The
+// routes are tried in order and all the given match fields must agree, the
+// default route takes anything left over and a reject route refuses the
+// FlowFile outright.
+//
+// A route may also copy every FlowFile to several URLs at once, in which case
+// Deliver decides how many of them must accept before the sender is told the
+// FlowFiles were received: "all" (the default), "any" or "quorum".
+type route struct {
+	Name       string            `json:"name"`
+	URL        string            `json:"url"`
+	URLs       []string          `json:"urls"`
+	Deliver    string            `json:"deliver"`
+	Quorum     int               `json:"quorum"` // Defaults to a majority of the URLs
+	Default    bool              `json:"default"`
+	Reject     bool              `json:"reject"`
+	Path       string            `json:"path"`       // Path prefix
+	Filename   string            `json:"filename"`   // Filename glob
+	Kind       string            `json:"kind"`       // FlowFile kind, "file" when not set
+	Host       string            `json:"host"`       // Glob of any custody chain hostname
+	Attributes map[string]string `json:"attributes"` // Globs of other attributes, like MY_group
+
+	filename *regexp.Regexp
+	host     *regexp.Regexp
+	attrs    map[string]*regexp.Regexp
+	hs       *flowfile.HTTPTransaction // The first downstream
+	targets  []routeTarget
+	metrics  *flowfile.Metrics
+	mutex    sync.Mutex
+	down     bool // Unavailable when starting up
+	spool    *spoolQueue
+}
+
+type routeTarget struct {
+	url string
+	hs  *flowfile.HTTPTransaction
+}
+
+var (
+	routesFile    = new(string)
+	fanoutTimeout = new(time.Duration)
+	routes        []*route
+	defaultRoute  *route
+)
+
+// Each downstream of a fan-out route holds at most this many chunks, so a
+// lagging downstream slows the others down rather than using up memory.
+const (
+	fanoutChunk = 32 << 10
+	fanoutDepth = 16
+)
+
+func route_flags() {
+	routesFile = flag.String("routes", "", "JSON file with a routing table sending FlowFiles to different URLs by their attributes\n"+
+		"FlowFiles not matching any route are sent to the default route, or to -url when there is none.")
+	fanoutTimeout = flag.Duration("fanout-timeout", time.Minute, "Time a downstream of a fan-out route may stall before it is dropped from the post")
+}
+
+// loadRoutes reads in the routing table and opens a transaction for every
+// downstream URL.  Without a table, everything goes to defaultURL.
+func loadRoutes(defaultURL string) {
+	if *routesFile != "" {
+		dat, err := os.ReadFile(*routesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = json.Unmarshal(dat, &routes); err != nil {
+			log.Fatal("Unable to parse routes file ", err)
+		}
+		fmt.Println("Loading routes from file", *routesFile)
+	}
+
+	for i, rt := range routes {
+		if rt.Name == "" {
+			rt.Name = fmt.Sprintf("route%d", i+1)
+		}
+		if rt.Default {
+			if defaultRoute != nil {
+				log.Fatal("More than one default route, ", rt.Name)
+			}
+			defaultRoute = rt
+		}
+		var err error
+		if rt.Filename != "" {
+			if rt.filename, err = compileGlob(rt.Filename); err != nil {
+				log.Fatal("Invalid filename for route ", rt.Name, err)
+			}
+		}
+		if rt.Host != "" {
+			if rt.host, err = compileGlob(rt.Host); err != nil {
+				log.Fatal("Invalid host for route ", rt.Name, err)
+			}
+		}
+		rt.attrs = make(map[string]*regexp.Regexp)
+		for name, pattern := range rt.Attributes {
+			if rt.attrs[name], err = compileGlob(pattern); err != nil {
+				log.Fatal("Invalid attribute ", name, " for route ", rt.Name, err)
+			}
+		}
+	}
+	if defaultRoute == nil {
+		defaultRoute = &route{Name: "default", URL: defaultURL, Default: true}
+		routes = append(routes, defaultRoute)
+	}
+
+	// Open a transaction to each downstream, routes to the same URL share one
+	byURL := make(map[string]*flowfile.HTTPTransaction)
+	for _, rt := range routes {
+		rt.metrics = flowfile.NewMetrics()
+		if rt.Reject {
+			log.Println("  Route", rt.Name, "rejects")
+			continue
+		}
+		urls := rt.URLs
+		if rt.URL != "" {
+			urls = append([]string{rt.URL}, urls...)
+		}
+		if len(urls) == 0 {
+			log.Fatal("Missing url for route ", rt.Name)
+		}
+		switch rt.Deliver {
+		case "":
+			rt.Deliver = "all"
+		case "all", "any", "quorum":
+		default:
+			log.Fatalf("Unknown deliver %q for route %s", rt.Deliver, rt.Name)
+		}
+		if rt.Quorum <= 0 {
+			rt.Quorum = len(urls)/2 + 1
+		} else if rt.Quorum > len(urls) {
+			log.Fatal("Quorum is larger than the number of urls for route ", rt.Name)
+		}
+		for _, u := range urls {
+			hs, ok := byURL[u]
+			if !ok {
+				log.Println("Creating sender for route", rt.Name+",", u)
+				var err error
+				if hs, err = flowfile.NewHTTPTransaction(u, tlsConfig); err != nil {
+					if *spoolPath == "" {
+						log.Fatal(err)
+					}
+					// Spool until the downstream can be reached
+					log.Println("  Downstream unavailable,", err)
+					hs, rt.down = flowfile.NewHTTPTransactionNoHandshake(u, tlsConfig), true
+				}
+				byURL[u] = hs
+			}
+			rt.targets = append(rt.targets, routeTarget{url: u, hs: hs})
+		}
+		rt.hs = rt.targets[0].hs
+		if len(rt.targets) > 1 {
+			log.Println("  Route", rt.Name, "copies to", len(rt.targets), "downstreams, delivered to", rt.Deliver)
+		}
+	}
+	if len(routes) > 1 {
+		fmt.Println("Loaded", len(routes), "routes.")
+	}
+
+	metricsSources = append(metricsSources, func(host, action string) string {
+		var out strings.Builder
+		for _, rt := range routes {
+			rt.mutex.Lock()
+			out.WriteString(rt.metrics.String("host", host, "action", action, "route", rt.Name))
+			rt.mutex.Unlock()
+		}
+		return out.String()
+	})
+}
+
+// routeTransactions lists the distinct downstream transactions
+func routeTransactions() (hss []*flowfile.HTTPTransaction) {
+	seen := make(map[*flowfile.HTTPTransaction]bool)
+	for _, rt := range routes {
+		for _, t := range rt.targets {
+			if !seen[t.hs] {
+				seen[t.hs] = true
+				hss = append(hss, t.hs)
+			}
+		}
+	}
+	return
+}
+
+// findRoute returns the first route matching the attributes, or the default
+func findRoute(attrs flowfile.Attributes) *route {
+	for _, rt := range routes {
+		if !rt.Default && rt.match(attrs) {
+			return rt
+		}
+	}
+	return defaultRoute
+}
+
+func (rt *route) match(attrs flowfile.Attributes) bool {
+	if rt.Path != "" {
+		dir := filepath.Clean(attrs.Get("path"))
+		prefix := filepath.Clean(rt.Path)
+		if dir != prefix && !strings.HasPrefix(dir, prefix+"/") {
+			return false
+		}
+	}
+	if rt.filename != nil && !rt.filename.MatchString(attrs.Get("filename")) {
+		return false
+	}
+	if rt.Kind != "" {
+		kind := attrs.Get("kind")
+		if kind == "" {
+			kind = "file"
+		}
+		if kind != rt.Kind {
+			return false
+		}
+	}
+	if rt.host != nil {
+		var found bool
+		for _, a := range attrs {
+			if strings.HasPrefix(a.Name, "custodyChain.") && strings.HasSuffix(a.Name, ".hostname") &&
+				rt.host.MatchString(a.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, re := range rt.attrs {
+		if !re.MatchString(attrs.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// counted records a FlowFile delivered through the route
+func (rt *route) counted(size int64) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.metrics.BucketCounter(size)
+}
+
+// delivered tells if enough downstreams accepted to satisfy the route
+func (rt *route) delivered(ok int) bool {
+	switch rt.Deliver {
+	case "any":
+		return ok >= 1
+	case "quorum":
+		return ok >= rt.Quorum
+	}
+	return ok == len(rt.targets)
+}
+
+// A routePost is the post opened to each downstream of a route for one
+// incoming request.
+type routePost struct {
+	rt   *route
+	legs []*routeLeg
+	sent []int64
+}
+
+type routeLeg struct {
+	url     string
+	hw      *flowfile.HTTPPostWriter
+	started bool
+	err     error
+}
+
+func (rt *route) open(r *http.Request) *routePost {
+	rp := &routePost{rt: rt}
+	for _, t := range rt.targets {
+		hw := t.hs.NewHTTPPostWriter()
+		if r == nil {
+			// Replayed from the spool
+		} else if xForwardFor := r.Header.Get("X-Forwarded-For"); xForwardFor != "" {
+			hw.Header.Set("X-Forwarded-For", r.RemoteAddr+","+xForwardFor)
+		} else {
+			hw.Header.Set("X-Forwarded-For", r.RemoteAddr)
+		}
+		rp.legs = append(rp.legs, &routeLeg{url: t.url, hw: hw})
+	}
+	return rp
+}
+
+// live lists the downstreams which have not failed
+func (rp *routePost) live() (legs []*routeLeg) {
+	for _, leg := range rp.legs {
+		if leg.err == nil {
+			legs = append(legs, leg)
+		}
+	}
+	return
+}
+
+// fail drops a downstream from the post
+func (leg *routeLeg) fail(err error) {
+	if leg.err == nil {
+		log.Println("  Dropping downstream", leg.url, err)
+		leg.err = err
+		leg.abort()
+	}
+}
+
+// abort ends the post, collecting the reply in the background as the post is
+// only opened on the first write
+func (leg *routeLeg) abort() {
+	leg.hw.Terminate()
+	if leg.started {
+		go leg.hw.Close()
+	}
+}
+
+// write sends a FlowFile to every downstream still in the post.  The content
+// is read once and copied to each one through a small queue, a downstream
+// which stalls for longer than the fanout-timeout is dropped.
+func (rp *routePost) write(f *flowfile.File) error {
+	for _, leg := range rp.live() {
+		leg.started = true
+	}
+	if len(rp.legs) == 1 {
+		_, err := rp.legs[0].hw.Write(f)
+		if err == nil {
+			rp.sent = append(rp.sent, f.Size)
+		}
+		return err
+	}
+
+	type feed struct {
+		leg  *routeLeg
+		ch   chan []byte
+		done chan error
+	}
+	var feeds []*feed
+	for _, leg := range rp.live() {
+		pr, pw := io.Pipe()
+		ff := flowfile.New(pr, f.Size)
+		ff.Attrs = append(flowfile.Attributes{}, f.Attrs...)
+		fd := &feed{leg: leg, ch: make(chan []byte, fanoutDepth), done: make(chan error, 1)}
+		go func(hw *flowfile.HTTPPostWriter) {
+			_, err := hw.Write(ff)
+			pr.CloseWithError(fmt.Errorf("Downstream write ended"))
+			fd.done <- err
+		}(leg.hw)
+		go func() {
+			var err error
+			for b := range fd.ch {
+				if err == nil {
+					_, err = pw.Write(b)
+				}
+			}
+			pw.Close()
+		}()
+		feeds = append(feeds, fd)
+	}
+
+	var err error
+	for {
+		buf := make([]byte, fanoutChunk)
+		n, rerr := f.Read(buf)
+		if n > 0 {
+			for _, fd := range feeds {
+				if fd.leg.err != nil {
+					continue
+				}
+				select {
+				case fd.ch <- buf[:n]:
+				case <-time.After(*fanoutTimeout):
+					fd.leg.fail(fmt.Errorf("Downstream stalled for %v", *fanoutTimeout))
+				}
+			}
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			err = rerr
+			break
+		}
+		if !rp.rt.delivered(len(rp.live())) {
+			err = fmt.Errorf("Too few downstreams left for route %s", rp.rt.Name)
+			break
+		}
+	}
+	for _, fd := range feeds {
+		close(fd.ch)
+	}
+	for _, fd := range feeds {
+		if werr := <-fd.done; werr != nil {
+			fd.leg.fail(werr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !rp.rt.delivered(len(rp.live())) {
+		return fmt.Errorf("Too few downstreams left for route %s", rp.rt.Name)
+	}
+	rp.sent = append(rp.sent, f.Size)
+	return nil
+}
+
+// terminate aborts the post to every downstream
+func (rp *routePost) terminate() {
+	for _, leg := range rp.live() {
+		leg.abort()
+	}
+}
+
+// close finishes the post to every downstream and checks that enough of them
+// accepted the FlowFiles.
+func (rp *routePost) close() error {
+	var ok int
+	var lastErr error
+	for _, leg := range rp.live() {
+		leg.hw.Close()
+		if leg.hw.Response == nil {
+			lastErr = fmt.Errorf("File did not send to %s, no response", leg.url)
+		} else if leg.hw.Response.StatusCode != 200 {
+			lastErr = &downstreamError{url: leg.url, code: leg.hw.Response.StatusCode, status: leg.hw.Response.Status}
+		} else {
+			ok++
+			continue
+		}
+		if len(rp.legs) > 1 {
+			log.Println("  Downstream failed,", lastErr)
+		}
+	}
+	if !rp.rt.delivered(ok) {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("Only %d of %d downstreams accepted for route %s", ok, len(rp.legs), rp.rt.Name)
+		}
+		return lastErr
+	}
+	for _, size := range rp.sent {
+		rp.rt.counted(size)
+	}
+	return nil
+}
+
+// A downstreamError is a downstream refusing the FlowFiles, as opposed to not
+// being reachable
+type downstreamError struct {
+	url, status string
+	code        int
+}
+
+func (e *downstreamError) Error() string {
+	return fmt.Sprintf("File did not send successfully to %s, Server replied: %s", e.url, e.status)
+}
+
+// refused tells if the downstream turned the FlowFiles away for good, rather
+// than being busy or unavailable for now
+func (e *downstreamError) refused() bool {
+	return e.code >= 400 && e.code < 500 && e.code != http.StatusRequestTimeout && e.code != http.StatusTooManyRequests
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschou/go-bunit"
+	"github.com/pschou/go-flowfile"
+)
+
+// Store and forward, when the downstream of a route is unavailable verified
+// FlowFiles are accepted into a spool on disk and replayed in the order they
+// arrived once a handshake succeeds again.  While a route has anything
+// spooled, newer FlowFiles are queued behind it to keep the order.  Replay
+// stops at any FlowFile still being written, and a FlowFile the downstream
+// keeps refusing is moved to a dead-letter directory so it does not hold up
+// the rest.
+
+var (
+	spoolPath    = new(string)
+	spoolMaxSize = new(string)
+	spoolRetry   = new(time.Duration)
+	spoolDead    = new(string)
+	spoolTries   = new(int)
+
+	spoolLimit int64
+	spoolLock  sync.Mutex
+	spoolBytes int64
+)
+
+// A spoolQueue holds the spooled FlowFiles of one route, named by sequence
+type spoolQueue struct {
+	dir      string
+	dead     string
+	seq      int64
+	files    []string
+	writing  map[int64]struct{} // Sequences handed out and not yet on disk
+	sizes    map[string]int64
+	refusals map[string]int
+	down     bool
+}
+
+func spool_flags() {
+	spoolPath = flag.String("spool", "", "Directory in which to hold FlowFiles while a downstream is unavailable, replaying them\n"+
+		"in order once it is back.  Default is disabled, returning an error to the sender.")
+	spoolMaxSize = flag.String("spool-max-size", "10GB", "Maximum total size of the spool, senders are refused with 503 once full")
+	spoolRetry = flag.Duration("spool-retry", 10*time.Second, "Time between handshakes with an unavailable downstream")
+	spoolDead = flag.String("spool-dead-letter", "", "Directory in which to move spooled FlowFiles which the downstream keeps refusing\n"+
+		"(default is spool/dead-letter)")
+	spoolTries = flag.Int("spool-max-attempts", 5, "Times a spooled FlowFile may be refused by the downstream before it is moved aside")
+}
+
+// spool_init loads anything spooled before a restart and starts replaying
+func spool_init() {
+	if *spoolPath == "" {
+		return
+	}
+	if bs, err := bunit.ParseBytes(*spoolMaxSize); err != nil {
+		log.Fatal("Unable to parse spool-max-size ", err)
+	} else {
+		spoolLimit = bs.Int64()
+	}
+	if *spoolDead == "" {
+		*spoolDead = path.Join(*spoolPath, "dead-letter")
+	}
+	log.Println("Spooling to", *spoolPath, "up to", *spoolMaxSize)
+
+	for _, rt := range routes {
+		if rt.Reject {
+			continue
+		}
+		q := &spoolQueue{dir: path.Join(*spoolPath, rt.Name), dead: path.Join(*spoolDead, rt.Name),
+			writing: make(map[int64]struct{}), sizes: make(map[string]int64), refusals: make(map[string]int)}
+		if path.Clean(q.dir) == path.Clean(*spoolDead) {
+			log.Fatal("The spool of route ", rt.Name, " is the dead-letter directory")
+		}
+		if err := os.MkdirAll(q.dir, 0755); err != nil {
+			log.Fatal("Unable to create spool ", err)
+		}
+		dirEntries, _ := os.ReadDir(q.dir)
+		for _, e := range dirEntries {
+			name := e.Name()
+			if strings.HasSuffix(name, ".tmp") {
+				os.Remove(path.Join(q.dir, name))
+				continue
+			}
+			seq, err := strconv.ParseInt(strings.TrimSuffix(name, ".ff"), 10, 64)
+			if err != nil || !strings.HasSuffix(name, ".ff") {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				spoolBytes += info.Size()
+				q.sizes[name] = info.Size()
+			}
+			q.files = append(q.files, name)
+			if seq > q.seq {
+				q.seq = seq
+			}
+		}
+		sort.Strings(q.files)
+		if len(q.files) > 0 {
+			log.Println("  Route", rt.Name, "has", len(q.files), "spooled FlowFiles")
+		}
+		q.down = rt.down
+		rt.spool = q
+	}
+
+	metricsGauges["flowfiles_spool_depth"] = func() int64 {
+		spoolLock.Lock()
+		defer spoolLock.Unlock()
+		var n int
+		for _, rt := range routes {
+			if rt.spool != nil {
+				n += len(rt.spool.files)
+			}
+		}
+		return int64(n)
+	}
+	metricsGauges["flowfiles_spool_bytes"] = func() int64 {
+		spoolLock.Lock()
+		defer spoolLock.Unlock()
+		return spoolBytes
+	}
+
+	go func() {
+		for {
+			for _, rt := range routes {
+				if rt.spool != nil {
+					spoolReplay(rt)
+				}
+			}
+			time.Sleep(*spoolRetry)
+		}
+	}()
+}
+
+// spooling tells if FlowFiles for the route are to go into the spool
+func (rt *route) spooling() bool {
+	if rt.spool == nil {
+		return false
+	}
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+	return rt.spool.down || len(rt.spool.files) > 0 || len(rt.spool.writing) > 0
+}
+
+// markDown notes that the downstream of a route is unavailable
+func (rt *route) markDown(err error) {
+	if rt.spool == nil {
+		return
+	}
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+	if !rt.spool.down {
+		log.Println("Spooling for route", rt.Name, "after error:", err)
+		rt.spool.down = true
+	}
+}
+
+// spoolWrite saves a FlowFile into the spool of a route, the verify function
+// is called once the content is on disk and only verified content is kept.
+func spoolWrite(rt *route, f *flowfile.File, verify func() error) (err error) {
+	q := rt.spool
+	size := int64(f.HeaderSize()) + f.Size
+	spoolLock.Lock()
+	if spoolBytes+size > spoolLimit {
+		spoolLock.Unlock()
+		return rejectf(http.StatusServiceUnavailable, "Spool is full, %v of %v used", bunit.NewBytes(spoolBytes), *spoolMaxSize)
+	}
+	spoolBytes += size
+	q.seq++
+	seq := q.seq
+	name := fmt.Sprintf("%020d.ff", seq)
+	q.writing[seq] = struct{}{}
+	spoolLock.Unlock()
+
+	defer func() {
+		spoolLock.Lock()
+		delete(q.writing, seq)
+		if err != nil {
+			spoolBytes -= size
+		}
+		spoolLock.Unlock()
+	}()
+
+	tmp := path.Join(q.dir, name+".tmp")
+	var fh *os.File
+	if fh, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+		return
+	}
+	_, err = flowfile.NewWriter(fh).Write(f)
+	if err == nil {
+		err = fh.Sync()
+	}
+	fh.Close()
+	if err == nil {
+		err = verify()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path.Join(q.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	// Files may finish out of order when several posts are spooling at once,
+	// the sequence is released by the deferred call after it is listed
+	spoolLock.Lock()
+	i := sort.SearchStrings(q.files, name)
+	q.files = append(q.files, "")
+	copy(q.files[i+1:], q.files[i:])
+	q.files[i] = name
+	q.sizes[name] = size
+	spoolLock.Unlock()
+	if *verbose {
+		log.Println("    Spooled as", path.Join(q.dir, name))
+	}
+	return
+}
+
+// next returns the first spooled FlowFile, unless an earlier one is still being
+// written.  Must be called with the spoolLock held.
+func (q *spoolQueue) next() (name string, ok bool) {
+	if len(q.files) == 0 {
+		return
+	}
+	seq, _ := strconv.ParseInt(strings.TrimSuffix(q.files[0], ".ff"), 10, 64)
+	for s := range q.writing {
+		if s < seq {
+			return
+		}
+	}
+	return q.files[0], true
+}
+
+// spoolReplay sends the spooled FlowFiles of a route in order, stopping at the
+// first failure.
+func spoolReplay(rt *route) {
+	q := rt.spool
+	spoolLock.Lock()
+	down, pending := q.down, len(q.files)
+	spoolLock.Unlock()
+
+	if down {
+		for _, t := range rt.targets {
+			if err := t.hs.Handshake(); err != nil {
+				if *verbose {
+					log.Println("Downstream", t.url, "still unavailable:", err)
+				}
+				return
+			}
+		}
+		log.Println("Downstream for route", rt.Name, "is available again,", pending, "FlowFiles spooled")
+		spoolLock.Lock()
+		q.down = false
+		spoolLock.Unlock()
+	}
+
+	for {
+		spoolLock.Lock()
+		name, ok := q.next()
+		spoolLock.Unlock()
+		if !ok {
+			return
+		}
+
+		// A spooled FlowFile lost or damaged on disk is no fault of the
+		// downstream, so it is dropped or set aside and the rest go on
+		fp := path.Join(q.dir, name)
+		err := spoolCheck(fp)
+		if os.IsNotExist(err) {
+			log.Println("Spooled", fp, "is gone, dropping it")
+			q.pop(name)
+			continue
+		} else if err != nil {
+			log.Println("Unable to read spooled", fp, err)
+			if err = spoolDeadLetter(q, name, err); err != nil {
+				log.Println("Unable to move", fp, "to the dead-letter directory", err)
+				return
+			}
+			q.pop(name)
+			continue
+		}
+
+		err = spoolSend(rt, fp)
+		if re, refused := err.(*downstreamError); refused && re.refused() {
+			// Try again later, moving it aside once refused too many times
+			spoolLock.Lock()
+			q.refusals[name]++
+			tries := q.refusals[name]
+			spoolLock.Unlock()
+			log.Println("Spooled", fp, "refused", tries, "of", *spoolTries, "times:", err)
+			if tries < *spoolTries {
+				return
+			}
+			if err = spoolDeadLetter(q, name, err); err != nil {
+				log.Println("Unable to move", fp, "to the dead-letter directory", err)
+				return
+			}
+		} else if err != nil {
+			rt.markDown(err)
+			return
+		} else {
+			os.Remove(fp)
+		}
+		q.pop(name)
+	}
+}
+
+// pop takes the first FlowFile off the queue once it is sent or set aside
+func (q *spoolQueue) pop(name string) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+	q.files = q.files[1:]
+	spoolBytes -= q.sizes[name]
+	delete(q.sizes, name)
+	delete(q.refusals, name)
+}
+
+// spoolCheck reads a spooled FlowFile through, making sure it is whole before
+// the downstream is blamed for it not sending
+func spoolCheck(fp string) error {
+	fh, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	s := flowfile.NewScanner(fh)
+	if !s.Scan() {
+		if err = s.Err(); err == nil || err == io.EOF {
+			err = fmt.Errorf("Empty spool file")
+		}
+		return err
+	}
+	f := s.File()
+
+	// A short file would never reach the end of the content
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if want := int64(f.HeaderSize()) + f.Size; info.Size() != want {
+		return fmt.Errorf("Spool file is %d bytes, expected %d", info.Size(), want)
+	}
+	if _, err = io.Copy(io.Discard, f); err != nil {
+		return err
+	}
+	if f.Attrs.Get("checksumType") != "" {
+		return f.Verify()
+	}
+	return nil
+}
+
+// spoolDeadLetter sets aside a spooled FlowFile, recording the error beside it
+func spoolDeadLetter(q *spoolQueue, name string, sendErr error) error {
+	log.Println("Moving", path.Join(q.dir, name), "to dead-letter directory", q.dead)
+	if err := os.MkdirAll(q.dead, 0755); err != nil {
+		return err
+	}
+	dead := path.Join(q.dead, name)
+	if err := os.WriteFile(strings.TrimSuffix(dead, ".ff")+".error", []byte(fmt.Sprintf("%s %s\n",
+		time.Now().Format(time.RFC3339), sendErr)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path.Join(q.dir, name), dead)
+}
+
+// spoolSend replays one spooled FlowFile to the downstreams of a route
+func spoolSend(rt *route, fp string) error {
+	fh, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	s := flowfile.NewScanner(fh)
+	if !s.Scan() {
+		if err = s.Err(); err == nil {
+			err = fmt.Errorf("Empty spool file %s", fp)
+		}
+		return err
+	}
+	f := s.File()
+	if *verbose {
+		log.Println("  Replaying", path.Join(f.Attrs.Get("path"), f.Attrs.Get("filename")), "from", fp)
+	}
+	rp := rt.open(nil)
+	if err = rp.write(f); err != nil {
+		rp.terminate()
+		return err
+	}
+	return rp.close()
+}
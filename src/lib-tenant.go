@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/pschou/go-bunit"
+)
+
+// A tenant maps a listen path and/or a client certificate subject onto an
+// output root with its own hook script and quota.  When tenants are loaded,
+// requests which do not match any tenant are rejected.
+type tenant struct {
+	Name       string `json:"name"`
+	ListenPath string `json:"listenPath"`
+	Subject    string `json:"subject"`
+	Path       string `json:"path"`
+	Script     string `json:"script"`
+	Quota      string `json:"quota"`
+
+	subject *regexp.Regexp
+	quota   int64
+	used    int64
+	mutex   sync.Mutex
+}
+
+var (
+	tenantsFile = new(string)
+	tenants     []*tenant
+)
+
+func tenant_flags() {
+	tenantsFile = flag.String("tenants", "", "JSON file mapping listen paths and client certificate subjects to output\n"+
+		"directories, scripts and quotas.  Clients not matching any rule are rejected.")
+}
+
+// loadTenants reads in the tenant rules, listen paths which are left empty
+// take on the default listen path.
+func loadTenants(defaultPath string) {
+	if *tenantsFile == "" {
+		return
+	}
+	dat, err := os.ReadFile(*tenantsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = json.Unmarshal(dat, &tenants); err != nil {
+		log.Fatal("Unable to parse tenants file ", err)
+	}
+	fmt.Println("Loading tenants from file", *tenantsFile)
+	for i, t := range tenants {
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("tenant%d", i+1)
+		}
+		if t.Path == "" {
+			log.Fatal("Missing path for tenant ", t.Name)
+		}
+		if t.ListenPath == "" {
+			t.ListenPath = defaultPath
+		}
+		if t.Subject != "" {
+			if t.subject, err = compileGlob(t.Subject); err != nil {
+				log.Fatal("Invalid subject for tenant ", t.Name, err)
+			}
+		}
+		if t.Quota != "" {
+			if bs, err := bunit.ParseBytes(t.Quota); err != nil {
+				log.Fatal("Unable to parse quota for tenant ", t.Name, err)
+			} else {
+				t.quota = bs.Int64()
+			}
+			t.used = dirSize(t.Path)
+		}
+		if *verbose {
+			log.Printf("  Tenant %s: listen %q subject %q -> %s (used %v of %q)\n", t.Name,
+				t.ListenPath, t.Subject, t.Path, bunit.NewBytes(t.used), t.Quota)
+		}
+	}
+	fmt.Println("Loaded", len(tenants), "tenants.")
+}
+
+// tenantHandle registers the handler for the default listen path or, when
+// tenants are in use, for every tenant listen path while rejecting requests
+// from clients which do not match a tenant.
+func tenantHandle(defaultPath string, h http.Handler) {
+	if len(tenants) == 0 {
+		http.Handle(defaultPath, h)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, t := range tenants {
+		if seen[t.ListenPath] {
+			continue
+		}
+		seen[t.ListenPath] = true
+		log.Println("Adding tenant listen path", t.ListenPath)
+		http.Handle(t.ListenPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if getTenant(r) == nil {
+				if *verbose {
+					log.Println("No tenant matched for", r.RemoteAddr, peerSubject(r), r.URL.Path)
+				}
+				http.Error(w, "403 no matching tenant", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// getTenant returns the first tenant matching the request, if any
+func getTenant(r *http.Request) *tenant {
+	if r == nil {
+		return nil
+	}
+	dn := peerSubject(r)
+	for _, t := range tenants {
+		if t.ListenPath != r.URL.Path {
+			continue
+		}
+		if t.subject != nil && !t.subject.MatchString(dn) {
+			continue
+		}
+		return t
+	}
+	return nil
+}
+
+// reserve checks that the tenant quota allows for n more bytes and holds them
+// while the file is saved, so parallel uploads cannot overrun the quota.  Any
+// bytes which end up not being kept must be handed back with release.
+func (t *tenant) reserve(n int64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.quota > 0 && t.used+n > t.quota {
+		return rejectf(http.StatusInsufficientStorage, "Quota exceeded for tenant %s (%v of %v used)", t.Name,
+			bunit.NewBytes(t.used), bunit.NewBytes(t.quota))
+	}
+	t.used += n
+	return nil
+}
+
+// release returns bytes held by reserve which were not kept
+func (t *tenant) release(n int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.used -= n; t.used < 0 {
+		t.used = 0
+	}
+}
+
+// dirSize sums up the size of the regular files in a directory tree
+func dirSize(dir string) (n int64) {
+	filepath.Walk(dir, func(fp string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			n += fi.Size()
+		}
+		return nil
+	})
+	return
+}
@@ -10,6 +10,8 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"regexp"
+	"strings"
 )
 
 var (
@@ -91,6 +93,24 @@ func certPKIXString(name pkix.Name, sep string) (out string) {
 	return
 }
 
+// peerSubject returns the subject DN of the verified client certificate on a
+// request, or an empty string when none was presented.
+func peerSubject(r *http.Request) string {
+	if r == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return certPKIXString(r.TLS.PeerCertificates[0].Subject, ",")
+}
+
+// compileGlob builds a case insensitive matcher for patterns like
+// "CN=*,OU=TeamA,*" where * matches any run of characters and ? matches one.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	return regexp.Compile("(?i)^" + expr + "$")
+}
+
 func LoadCertficatesFromFile(path string) error {
 	raw, err := ioutil.ReadFile(path)
 	if err != nil {
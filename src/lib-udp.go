@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"log"
 	"strconv"
 	"strings"
@@ -76,6 +79,96 @@ var ffHeaderSize = func() uint64 {
 	return uint64(buf.Len())
 }()
 
+// The version 2 header leads with a magic number, so stray traffic is told
+// apart from the link, and the version and flags so the format can evolve.
+// The CRC32C covers the whole packet, with the CRC field as zeros, so a
+// corrupted packet is dropped on arrival rather than failing the checksum of
+// the entire file.  Version 1 packets are a bare ffHeader.
+type ffHeaderV2 struct {
+	Magic   uint32
+	Version uint8
+	Flags   uint8
+	CRC     uint32
+	ffHeader
+}
+
+const (
+	ffMagic     = 0x46467544 // "FFuD"
+	ffVersion   = 2
+	ffCRCOffset = 6
+
+	ffFlagParity = 1 << 0 // The payload is a FEC parity shard
+)
+
+var (
+	ffHeaderV2Size = ffHeaderSize + 10
+	crcTable       = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// ffHeaderLen is the size of the header for a version of the packets
+func ffHeaderLen(version int) int {
+	if version < 2 {
+		return int(ffHeaderSize)
+	}
+	return int(ffHeaderV2Size)
+}
+
+// writeHeader starts a packet in the version given, sealPacket is to be
+// called once the payload is added.
+func writeHeader(buf *bytes.Buffer, version int, flags uint8, hdr *ffHeader) {
+	if version < 2 {
+		binary.Write(buf, binary.BigEndian, hdr)
+		return
+	}
+	binary.Write(buf, binary.BigEndian, &ffHeaderV2{
+		Magic:    ffMagic,
+		Version:  ffVersion,
+		Flags:    flags,
+		ffHeader: *hdr,
+	})
+}
+
+// sealPacket fills in the CRC of a version 2 packet
+func sealPacket(pkt []byte, version int) {
+	if version >= 2 {
+		binary.BigEndian.PutUint32(pkt[ffCRCOffset:], 0)
+		binary.BigEndian.PutUint32(pkt[ffCRCOffset:], crc32.Checksum(pkt, crcTable))
+	}
+}
+
+var errBadPacket = errors.New("Not a FlowFile packet")
+
+// parseHeader reads the header of a packet in either version, returning the
+// payload after it.  Version 2 packets must have a good CRC, version 1 ones
+// are only taken when acceptV1 is set.
+func parseHeader(pkt []byte, acceptV1 bool) (hdr ffHeader, version int, flags uint8, payload []byte, err error) {
+	if len(pkt) >= int(ffHeaderV2Size) && binary.BigEndian.Uint32(pkt) == ffMagic {
+		var h ffHeaderV2
+		binary.Read(bytes.NewReader(pkt), binary.BigEndian, &h)
+		if h.Version != ffVersion {
+			return hdr, int(h.Version), 0, nil, fmt.Errorf("Unsupported packet version %d", h.Version)
+		}
+		crc := crc32.Update(0, crcTable, pkt[:ffCRCOffset])
+		crc = crc32.Update(crc, crcTable, []byte{0, 0, 0, 0})
+		crc = crc32.Update(crc, crcTable, pkt[ffCRCOffset+4:])
+		if crc != h.CRC {
+			return hdr, ffVersion, 0, nil, fmt.Errorf("Bad packet CRC %08x, expected %08x", h.CRC, crc)
+		}
+		if h.MTU == 0 || len(pkt)-int(ffHeaderV2Size) > int(h.MTU)+fecHeaderSize {
+			return hdr, ffVersion, 0, nil, errBadPacket
+		}
+		return h.ffHeader, ffVersion, h.Flags, pkt[ffHeaderV2Size:], nil
+	}
+	if !acceptV1 || len(pkt) < int(ffHeaderSize) {
+		return hdr, 1, 0, nil, errBadPacket
+	}
+	binary.Read(bytes.NewReader(pkt), binary.BigEndian, &hdr)
+	if hdr.MTU < 100 {
+		return hdr, 1, 0, nil, errBadPacket
+	}
+	return hdr, 1, 0, pkt[ffHeaderSize:], nil
+}
+
 var copyBufPool = sync.Pool{
 	New: func() any {
 		b := make([]byte, 32<<10)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testPacket(version int, flags uint8, hdr *ffHeader, payload string) []byte {
+	var buf bytes.Buffer
+	writeHeader(&buf, version, flags, hdr)
+	buf.WriteString(payload)
+	sealPacket(buf.Bytes(), version)
+	return buf.Bytes()
+}
+
+func TestParseHeader(t *testing.T) {
+	hdr := ffHeader{Size: 5000, Offset: 1200, MTU: 1200}
+	copy(hdr.UUID[:], "0123456789abcdef")
+	v2 := func(pkt []byte) []byte { return pkt }
+
+	tests := []struct {
+		name     string
+		version  int
+		flags    uint8
+		acceptV1 bool
+		mangle   func([]byte) []byte
+		err      string // Empty when the packet is taken
+	}{
+		{"v2", 2, 0, false, v2, ""},
+		{"v2 parity", 2, ffFlagParity, false, v2, ""},
+		{"v2 with v1 accepted", 2, 0, true, v2, ""},
+		{"v1 accepted", 1, 0, true, v2, ""},
+		{"v1 refused", 1, 0, false, v2, errBadPacket.Error()},
+		{"flipped payload byte", 2, 0, false, func(p []byte) []byte { p[len(p)-1] ^= 1; return p }, "Bad packet CRC"},
+		{"flipped header byte", 2, 0, false, func(p []byte) []byte { p[ffCRCOffset+8] ^= 0x80; return p }, "Bad packet CRC"},
+		{"flipped flags", 2, 0, false, func(p []byte) []byte { p[5] ^= ffFlagParity; return p }, "Bad packet CRC"},
+		{"flipped CRC", 2, 0, false, func(p []byte) []byte { p[ffCRCOffset] ^= 1; return p }, "Bad packet CRC"},
+		{"bad magic", 2, 0, false, func(p []byte) []byte { p[0] ^= 1; return p }, errBadPacket.Error()},
+		{"other version", 2, 0, false, func(p []byte) []byte { p[4] = ffVersion + 1; return p }, "Unsupported packet version"},
+		{"oversized payload", 2, 0, false, func(p []byte) []byte {
+			p = append(p, make([]byte, int(hdr.MTU)+fecHeaderSize)...)
+			sealPacket(p, 2)
+			return p
+		}, errBadPacket.Error()},
+		{"short", 2, 0, true, func(p []byte) []byte { return p[:ffHeaderSize-1] }, errBadPacket.Error()},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pkt := tc.mangle(testPacket(tc.version, tc.flags, &hdr, "hello"))
+			got, version, flags, payload, err := parseHeader(pkt, tc.acceptV1)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected an error with %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != hdr || version != tc.version || flags != tc.flags || string(payload) != "hello" {
+				t.Fatalf("Expected %v v%d flags %d, got %v v%d flags %d payload %q",
+					hdr, tc.version, tc.flags, got, version, flags, payload)
+			}
+		})
+	}
+}
+
+func TestHeaderLen(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		pkt := testPacket(version, 0, &ffHeader{MTU: 1200}, "")
+		if len(pkt) != ffHeaderLen(version) {
+			t.Fatalf("Expected a v%d header of %d bytes, got %d", version, ffHeaderLen(version), len(pkt))
+		}
+	}
+	if _, _, _, _, err := parseHeader(nil, true); !errors.Is(err, errBadPacket) {
+		t.Fatalf("Expected %v, got %v", errBadPacket, err)
+	}
+}
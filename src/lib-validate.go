@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pschou/go-bunit"
+	"github.com/pschou/go-flowfile"
+)
+
+// Structured content is checked to be well formed, within limits, and when an
+// attribute names a schema, valid against that JSON Schema or XSD before it
+// is forwarded.  The format is taken from the mime.type attribute or else the
+// file extension.
+type validation struct {
+	Formats         []string          `json:"formats"` // Any of json, xml and csv
+	MaxSize         string            `json:"maxSize"` // Content is held in memory to check, default 64MB
+	MaxDepth        int               `json:"maxDepth"`
+	AllowDoctype    bool              `json:"allowDoctype"`
+	SchemaAttribute string            `json:"schemaAttribute"`
+	Schemas         map[string]string `json:"schemas"` // Name to a .json or .xsd file
+	RequireSchema   bool              `json:"requireSchema"`
+	Quarantine      bool              `json:"quarantine"`
+
+	maxSize     int64
+	jsonSchemas map[string]*jsonSchema
+	xsdSchemas  map[string]*xsdSchema
+}
+
+var (
+	validateFile = new(string)
+	validate     *validation
+)
+
+func validate_flags() {
+	validateFile = flag.String("validate", "", "JSON file with the checks for structured content: formats to check, size and\n"+
+		"depth limits and the JSON Schemas or XSDs picked by attribute.")
+}
+
+// loadValidation reads in the checks and compiles the schemas
+func loadValidation() {
+	if *validateFile == "" {
+		return
+	}
+	dat, err := os.ReadFile(*validateFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	validate = &validation{}
+	if err = json.Unmarshal(dat, validate); err != nil {
+		log.Fatal("Unable to parse validate file ", err)
+	}
+	fmt.Println("Loading content validation from file", *validateFile)
+	if len(validate.Formats) == 0 {
+		validate.Formats = []string{"json", "xml", "csv"}
+	}
+	if validate.MaxDepth == 0 {
+		validate.MaxDepth = 64
+	}
+	if validate.SchemaAttribute == "" {
+		validate.SchemaAttribute = "schema.name"
+	}
+	if validate.MaxSize == "" {
+		validate.MaxSize = "64MB"
+	}
+	if bs, err := bunit.ParseBytes(validate.MaxSize); err != nil {
+		log.Fatal("Unable to parse validate maxSize ", err)
+	} else if validate.maxSize = bs.Int64(); validate.maxSize <= 0 {
+		log.Fatal("The validate maxSize must be above zero")
+	}
+
+	// Schema files are relative to the validate file
+	validate.jsonSchemas = make(map[string]*jsonSchema)
+	validate.xsdSchemas = make(map[string]*xsdSchema)
+	for name, file := range validate.Schemas {
+		if !path.IsAbs(file) {
+			file = path.Join(path.Dir(*validateFile), file)
+		}
+		if strings.HasSuffix(strings.ToLower(file), ".xsd") {
+			validate.xsdSchemas[name], err = loadXSD(file)
+		} else {
+			validate.jsonSchemas[name], err = loadJSONSchema(file)
+		}
+		if err != nil {
+			log.Fatal("Unable to load schema ", name, " ", err)
+		}
+	}
+	if *verbose {
+		log.Printf("  Formats %q, max size %q, max depth %d, %d schemas by %s\n", validate.Formats,
+			validate.MaxSize, validate.MaxDepth, len(validate.Schemas), validate.SchemaAttribute)
+	}
+}
+
+// format determines which of the checked formats a FlowFile is in, if any.
+// Either the mime.type attribute or the extension of the filename naming a
+// checked format is enough, so neither can be set to skip the checks.
+func (v *validation) format(attrs flowfile.Attributes) (string, error) {
+	var byMIME, byName string
+	mime := strings.ToLower(attrs.Get("mime.type"))
+	if i := strings.Index(mime, ";"); i > 0 {
+		mime = strings.TrimSpace(mime[:i])
+	}
+	switch {
+	case mime == "application/json" || strings.HasSuffix(mime, "+json"):
+		byMIME = "json"
+	case mime == "application/xml" || mime == "text/xml" || strings.HasSuffix(mime, "+xml"):
+		byMIME = "xml"
+	case mime == "text/csv":
+		byMIME = "csv"
+	}
+	name := attrs.Get("filename")
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		byName = "json"
+	case ".xml":
+		byName = "xml"
+	case ".csv":
+		byName = "csv"
+	}
+	if !hasString(v.Formats, byMIME) {
+		byMIME = ""
+	}
+	if !hasString(v.Formats, byName) {
+		byName = ""
+	}
+	if byMIME != "" && byName != "" && byMIME != byName {
+		return "", fmt.Errorf("Content type %q does not match the name %q", mime, name)
+	}
+	if byMIME != "" {
+		return byMIME, nil
+	}
+	return byName, nil
+}
+
+// check validates the content read from r, refusing what fails
+func (v *validation) check(f *flowfile.File, r io.Reader) error {
+	name := f.Attrs.Get("filename")
+	schema := f.Attrs.Get(v.SchemaAttribute)
+	format, err := v.format(f.Attrs)
+	if err != nil {
+		return rejectf(http.StatusUnprocessableEntity, "Invalid %q: %v", name, err)
+	}
+	if schema == "" && v.RequireSchema {
+		return rejectf(http.StatusUnprocessableEntity, "Missing %s on %q", v.SchemaAttribute, name)
+	}
+	if format == "" && schema == "" {
+		return nil
+	}
+	if f.Attrs.Get("fragment.index") != "" {
+		return rejectf(http.StatusRequestEntityTooLarge, "Segmented %q cannot be validated, send it whole", name)
+	}
+	if f.Size > v.maxSize {
+		return rejectf(http.StatusRequestEntityTooLarge, "Size %v of %q is over the validation limit of %v",
+			bunit.NewBytes(f.Size), name, bunit.NewBytes(v.maxSize))
+	}
+
+	switch {
+	case schema != "" && v.jsonSchemas[schema] != nil:
+		err = v.checkJSON(r, v.jsonSchemas[schema])
+	case schema != "" && v.xsdSchemas[schema] != nil:
+		err = v.checkXML(r, v.xsdSchemas[schema])
+	case schema != "":
+		return rejectf(http.StatusUnprocessableEntity, "Unknown schema %q for %q", schema, name)
+	case format == "json":
+		err = v.checkJSON(r, nil)
+	case format == "xml":
+		err = v.checkXML(r, nil)
+	case format == "csv":
+		err = checkCSV(r)
+	}
+	if err != nil {
+		return rejectf(http.StatusUnprocessableEntity, "Invalid %q: %v", name, err)
+	}
+	if *verbose {
+		log.Println("    Validated", name, format, schema)
+	}
+	return nil
+}
+
+// checkJSON makes sure the content is a single JSON value within the depth
+// limit, and when a schema is given, validates it.
+func (v *validation) checkJSON(r io.Reader, schema *jsonSchema) error {
+	// The value is built as the tokens come, so the depth is known before any
+	// deeper nesting is read
+	type frame struct {
+		obj     map[string]interface{}
+		arr     []interface{}
+		key     string
+		haveKey bool
+	}
+	var doc interface{}
+	var done bool
+	var stack []*frame
+	add := func(val interface{}) {
+		if len(stack) == 0 {
+			doc, done = val, true
+			return
+		}
+		top := stack[len(stack)-1]
+		if top.obj != nil {
+			top.obj[top.key], top.haveKey = val, false
+		} else {
+			top.arr = append(top.arr, val)
+		}
+	}
+
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if done {
+			return fmt.Errorf("Data after the JSON value")
+		}
+		if len(stack) > 0 {
+			if top := stack[len(stack)-1]; top.obj != nil && !top.haveKey && tok != json.Delim('}') {
+				top.key, top.haveKey = tok.(string), true
+				if _, dup := top.obj[top.key]; dup {
+					return fmt.Errorf("Duplicate key %q", top.key)
+				}
+				continue
+			}
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			if len(stack) >= v.MaxDepth {
+				return fmt.Errorf("Nested deeper than %d", v.MaxDepth)
+			}
+			fr := &frame{arr: []interface{}{}}
+			if tok == json.Delim('{') {
+				fr.obj = make(map[string]interface{})
+			}
+			stack = append(stack, fr)
+		case json.Delim('}'), json.Delim(']'):
+			fr := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if fr.obj != nil {
+				add(fr.obj)
+			} else {
+				add(fr.arr)
+			}
+		default:
+			add(tok)
+		}
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("Unexpected end of JSON")
+	} else if !done {
+		return fmt.Errorf("Empty JSON")
+	}
+	if schema != nil {
+		return schema.validate(doc, "$")
+	}
+	return nil
+}
+
+// checkXML makes sure the content is a single well formed XML document within
+// the depth limit, without a DOCTYPE unless allowed, and when a schema is
+// given, validates it.
+func (v *validation) checkXML(r io.Reader, schema *xsdSchema) error {
+	dec := xml.NewDecoder(r)
+	var root *xmlNode
+	var stack []*xmlNode
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.Directive:
+			if !v.AllowDoctype {
+				return fmt.Errorf("DOCTYPE is not allowed")
+			}
+		case xml.StartElement:
+			if len(stack) >= v.MaxDepth {
+				return fmt.Errorf("Nested deeper than %d", v.MaxDepth)
+			}
+			if root != nil && len(stack) == 0 {
+				return fmt.Errorf("More than one root element")
+			}
+			n := &xmlNode{name: t.Name.Local}
+			if schema != nil {
+				n.attrs = t.Attr
+			}
+			if len(stack) == 0 {
+				root = n
+			} else if schema != nil {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) == 0 {
+				if strings.TrimSpace(string(t)) != "" {
+					return fmt.Errorf("Text outside of the root element")
+				}
+			} else if schema != nil {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+	if root == nil {
+		return fmt.Errorf("No root element")
+	}
+	if schema != nil {
+		return schema.validate(root)
+	}
+	return nil
+}
+
+// checkCSV makes sure every record parses and has the same number of fields
+func checkCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	for {
+		if _, err := cr.Read(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateFormat(t *testing.T) {
+	v := &validation{Formats: []string{"json", "xml", "csv"}, MaxDepth: 64, SchemaAttribute: "schema.name", maxSize: 1 << 20}
+
+	tests := []struct {
+		name  string
+		body  string
+		attrs []string
+		ok    bool
+	}{
+		{"json by type", `{"a": 1}`, []string{"filename", "data", "mime.type", "application/json"}, true},
+		{"bad json by type", `{"a": `, []string{"filename", "data", "mime.type", "application/json; charset=utf-8"}, false},
+		{"bad json by name", `{"a": `, []string{"filename", "data.json"}, false},
+		{"bad json with another type", `{"a": `, []string{"filename", "data.json", "mime.type", "application/octet-stream"}, false},
+		{"bad xml with another type", `<a>`, []string{"filename", "x.XML", "mime.type", "text/plain"}, false},
+		{"type and name disagree", `{"a": 1}`, []string{"filename", "x.xml", "mime.type", "application/json"}, false},
+		{"original name of a whole file", `{"a": `, []string{"filename", "data.json", "segment.original.filename", "data.bin"}, false},
+		{"not checked", `{"a": `, []string{"filename", "data.bin", "mime.type", "application/octet-stream"}, true},
+		{"csv", "a,b\n1,2\n", []string{"filename", "t.csv"}, true},
+		{"bad csv", "a,b\n1\n", []string{"filename", "t.csv", "mime.type", "text/plain"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := testFlowFile(tc.body, tc.attrs...)
+			err := v.check(f, strings.NewReader(tc.body))
+			if tc.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var pe *policyError
+			if !errors.As(err, &pe) || pe.status != http.StatusUnprocessableEntity {
+				t.Fatalf("Expected to be refused, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An xsdSchema validates XML against the common part of XML Schema: global
+// and local elements, named and inline complex and simple types, sequence,
+// choice, all and any with occurrence counts, attributes, simple content,
+// lists, unions and restrictions of the built in types with enumerations,
+// patterns, lengths and ranges.  Names are compared without their namespace.
+// A schema using anything else, such as complexContent, groups or includes,
+// is refused rather than only partly enforced.
+type xsdSchema struct {
+	elements     map[string]*xmlNode
+	complexTypes map[string]*xmlNode
+	simpleTypes  map[string]*xmlNode
+	patterns     map[string]*regexp.Regexp
+}
+
+// An xmlNode is an element of a parsed document
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     string
+}
+
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Local == name && a.Name.Space == "" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// loadXSD reads in a schema
+func loadXSD(file string) (*xsdSchema, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	root, err := parseXMLTree(fh)
+	if err != nil {
+		return nil, err
+	}
+	if root.name != "schema" {
+		return nil, fmt.Errorf("Not an XML Schema")
+	}
+	s := &xsdSchema{
+		elements:     make(map[string]*xmlNode),
+		complexTypes: make(map[string]*xmlNode),
+		simpleTypes:  make(map[string]*xmlNode),
+		patterns:     make(map[string]*regexp.Regexp),
+	}
+	for _, c := range root.children {
+		switch c.name {
+		case "element":
+			s.elements[c.attr("name")] = c
+		case "complexType":
+			s.complexTypes[c.attr("name")] = c
+		case "simpleType":
+			s.simpleTypes[c.attr("name")] = c
+		}
+	}
+	if len(s.elements) == 0 {
+		return nil, fmt.Errorf("No global elements")
+	}
+	return s, s.check(root)
+}
+
+// xsdConstructs are the parts of XML Schema which are enforced, with the
+// children and attributes each may have.  Annotations may go anywhere.
+var xsdConstructs = map[string]struct{ children, attrs []string }{
+	"schema": {[]string{"element", "complexType", "simpleType"},
+		[]string{"targetNamespace", "elementFormDefault", "attributeFormDefault", "version", "id"}},
+	"element":       {[]string{"complexType", "simpleType"}, []string{"name", "type", "ref", "minOccurs", "maxOccurs", "form", "id"}},
+	"complexType":   {[]string{"sequence", "choice", "all", "attribute", "anyAttribute", "simpleContent"}, []string{"name", "mixed", "id"}},
+	"sequence":      {[]string{"element", "any", "sequence", "choice"}, []string{"minOccurs", "maxOccurs", "id"}},
+	"choice":        {[]string{"element", "any", "sequence", "choice"}, []string{"minOccurs", "maxOccurs", "id"}},
+	"all":           {[]string{"element"}, []string{"minOccurs", "maxOccurs", "id"}},
+	"any":           {nil, []string{"minOccurs", "maxOccurs", "namespace", "processContents", "id"}},
+	"anyAttribute":  {nil, []string{"namespace", "processContents", "id"}},
+	"attribute":     {[]string{"simpleType"}, []string{"name", "type", "use", "default", "form", "id"}},
+	"simpleContent": {[]string{"extension"}, []string{"id"}},
+	"extension":     {[]string{"attribute", "anyAttribute"}, []string{"base", "id"}},
+	"simpleType":    {[]string{"restriction", "list", "union"}, []string{"name", "id"}},
+	"restriction": {[]string{"enumeration", "pattern", "length", "minLength", "maxLength", "minInclusive",
+		"maxInclusive", "minExclusive", "maxExclusive", "whiteSpace"}, []string{"base", "id"}},
+	"list":         {[]string{"simpleType"}, []string{"itemType", "id"}},
+	"union":        {[]string{"simpleType"}, []string{"memberTypes", "id"}},
+	"enumeration":  {nil, []string{"value", "id"}},
+	"pattern":      {nil, []string{"value", "id"}},
+	"length":       {nil, []string{"value", "fixed", "id"}},
+	"minLength":    {nil, []string{"value", "fixed", "id"}},
+	"maxLength":    {nil, []string{"value", "fixed", "id"}},
+	"minInclusive": {nil, []string{"value", "fixed", "id"}},
+	"maxInclusive": {nil, []string{"value", "fixed", "id"}},
+	"minExclusive": {nil, []string{"value", "fixed", "id"}},
+	"maxExclusive": {nil, []string{"value", "fixed", "id"}},
+	"whiteSpace":   {nil, []string{"value", "fixed", "id"}},
+}
+
+// check makes sure a schema only uses what is enforced and that every type
+// and reference resolves, compiling the patterns on the way
+func (s *xsdSchema) check(n *xmlNode) error {
+	spec := xsdConstructs[n.name]
+	for _, a := range n.attrs {
+		if a.Name.Space == "" && a.Name.Local != "xmlns" && !hasString(spec.attrs, a.Name.Local) {
+			return fmt.Errorf("Unsupported %s on <%s>", a.Name.Local, n.name)
+		}
+	}
+
+	// Types which may hold text, and for an element also the complex types
+	simpleRef := func(attr string, complexOK bool) error {
+		for _, t := range strings.Fields(n.attr(attr)) {
+			name := localName(t)
+			if s.simpleTypes[name] == nil && !xsdBuiltins[name] && !(complexOK && s.complexTypes[name] != nil) {
+				return fmt.Errorf("Unknown type %q in <%s>", t, n.name)
+			}
+		}
+		return nil
+	}
+	var err error
+	switch n.name {
+	case "element":
+		if ref := n.attr("ref"); ref != "" && s.elements[localName(ref)] == nil {
+			return fmt.Errorf("Unknown element reference %q", ref)
+		} else if ref == "" && n.attr("name") == "" {
+			return fmt.Errorf("Element without a name")
+		}
+		err = simpleRef("type", true)
+	case "attribute":
+		if n.attr("name") == "" {
+			return fmt.Errorf("Attribute without a name")
+		}
+		err = simpleRef("type", false)
+	case "any", "anyAttribute":
+		if pc := n.attr("processContents"); pc != "" && pc != "strict" && pc != "lax" && pc != "skip" {
+			return fmt.Errorf("Invalid processContents %q", pc)
+		}
+	case "extension":
+		err = simpleRef("base", false)
+	case "restriction":
+		if n.attr("base") == "" {
+			return fmt.Errorf("Restriction without a base")
+		}
+		if st := s.simpleTypes[localName(n.attr("base"))]; st != nil {
+			for _, c := range st.children {
+				if c.name == "list" || c.name == "union" {
+					return fmt.Errorf("Restriction of the %s type %q is not supported", c.name, n.attr("base"))
+				}
+			}
+		}
+		err = simpleRef("base", false)
+	case "list":
+		if (n.attr("itemType") == "") == (len(n.children) == 0) {
+			return fmt.Errorf("List needs one of an itemType or a simpleType")
+		}
+		err = simpleRef("itemType", false)
+	case "union":
+		if n.attr("memberTypes") == "" && len(n.children) == 0 {
+			return fmt.Errorf("Union without members")
+		}
+		err = simpleRef("memberTypes", false)
+	case "pattern":
+		// XSD patterns are implicitly anchored
+		var re *regexp.Regexp
+		if re, err = regexp.Compile("^(?:" + n.attr("value") + ")$"); err == nil {
+			s.patterns[n.attr("value")] = re
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, c := range n.children {
+		if c.name == "annotation" {
+			continue
+		}
+		if !hasString(spec.children, c.name) {
+			return fmt.Errorf("Unsupported <%s> in <%s>", c.name, n.name)
+		}
+		if err := s.check(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseXMLTree reads a whole document into nodes
+func parseXMLTree(r io.Reader) (*xmlNode, error) {
+	dec := xml.NewDecoder(r)
+	var root *xmlNode
+	var stack []*xmlNode
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name.Local, attrs: t.Attr}
+			if len(stack) == 0 {
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("No root element")
+	}
+	return root, nil
+}
+
+// validate checks a document against the global element of the same name
+func (s *xsdSchema) validate(root *xmlNode) error {
+	decl, ok := s.elements[root.name]
+	if !ok {
+		return fmt.Errorf("Unexpected root element <%s>", root.name)
+	}
+	return s.element(root, decl, "/"+root.name)
+}
+
+// element checks a node against an element declaration
+func (s *xsdSchema) element(n, decl *xmlNode, at string) error {
+	if ref := localName(decl.attr("ref")); ref != "" {
+		if decl = s.elements[ref]; decl == nil {
+			return fmt.Errorf("Unknown element reference %q", ref)
+		}
+	}
+	if t := decl.attr("type"); t != "" {
+		name := localName(t)
+		if ct, ok := s.complexTypes[name]; ok {
+			return s.complex(n, ct, at)
+		}
+		if len(n.children) > 0 {
+			return fmt.Errorf("%s should only have text", at)
+		}
+		return s.simple(strings.TrimSpace(n.text), name, at)
+	}
+	for _, c := range decl.children {
+		switch c.name {
+		case "complexType":
+			return s.complex(n, c, at)
+		case "simpleType":
+			if len(n.children) > 0 {
+				return fmt.Errorf("%s should only have text", at)
+			}
+			return s.simpleType(strings.TrimSpace(n.text), c, at)
+		}
+	}
+	return nil // anyType
+}
+
+// complex checks a node against a complex type
+func (s *xsdSchema) complex(n, ct *xmlNode, at string) error {
+	var particle *xmlNode
+	attrDecls := ct
+	for _, c := range ct.children {
+		switch c.name {
+		case "sequence", "choice", "all":
+			particle = c
+		case "simpleContent":
+			for _, ext := range c.children {
+				if ext.name == "extension" {
+					if len(n.children) > 0 {
+						return fmt.Errorf("%s should only have text", at)
+					}
+					if err := s.simple(strings.TrimSpace(n.text), localName(ext.attr("base")), at); err != nil {
+						return err
+					}
+					attrDecls = ext
+				}
+			}
+		}
+	}
+	if err := s.attributes(n, attrDecls, at); err != nil {
+		return err
+	}
+	if ct.attr("mixed") != "true" && particle != nil && strings.TrimSpace(n.text) != "" {
+		return fmt.Errorf("%s should not have text", at)
+	}
+	if particle == nil {
+		if len(n.children) > 0 {
+			return fmt.Errorf("%s should not have <%s>", at, n.children[0].name)
+		}
+		return nil
+	}
+	i, err := s.particle(n.children, 0, particle, at)
+	if err != nil {
+		return err
+	}
+	if i < len(n.children) {
+		return fmt.Errorf("%s has unexpected <%s>", at, n.children[i].name)
+	}
+	return nil
+}
+
+// attributes checks the attributes of a node against the declarations
+func (s *xsdSchema) attributes(n, decls *xmlNode, at string) error {
+	declared := make(map[string]bool)
+	anyAttr := false
+	for _, d := range decls.children {
+		switch d.name {
+		case "anyAttribute":
+			// No attributes are declared globally, so strict allows none
+			pc := d.attr("processContents")
+			anyAttr = pc == "lax" || pc == "skip"
+		case "attribute":
+			name := d.attr("name")
+			declared[name] = true
+			val, found := "", false
+			for _, a := range n.attrs {
+				if a.Name.Local == name && a.Name.Space == "" {
+					val, found = a.Value, true
+				}
+			}
+			if !found {
+				if d.attr("use") == "required" {
+					return fmt.Errorf("%s is missing @%s", at, name)
+				}
+				continue
+			}
+			if t := d.attr("type"); t != "" {
+				if err := s.simple(val, localName(t), at+"/@"+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, a := range n.attrs {
+		if a.Name.Space != "" || a.Name.Local == "xmlns" {
+			continue // Namespace declarations and xsi attributes
+		}
+		if !declared[a.Name.Local] && !anyAttr {
+			return fmt.Errorf("%s has unexpected @%s", at, a.Name.Local)
+		}
+	}
+	return nil
+}
+
+// occurs reads the minOccurs and maxOccurs of a particle, -1 is unbounded
+func occurs(p *xmlNode) (min, max int) {
+	min, max = 1, 1
+	if v := p.attr("minOccurs"); v != "" {
+		min, _ = strconv.Atoi(v)
+	}
+	if v := p.attr("maxOccurs"); v == "unbounded" {
+		max = -1
+	} else if v != "" {
+		max, _ = strconv.Atoi(v)
+	}
+	return
+}
+
+// particle matches children from index i against a particle, returning the
+// index after what was matched.  Matching is greedy without backtracking.
+func (s *xsdSchema) particle(children []*xmlNode, i int, p *xmlNode, at string) (int, error) {
+	min, max := occurs(p)
+	count := 0
+	for max < 0 || count < max {
+		next, ok, err := s.once(children, i, p, at)
+		if err != nil {
+			return next, err
+		}
+		if !ok || (next == i && count >= min) {
+			break
+		}
+		i = next
+		count++
+	}
+	if count < min {
+		if i < len(children) {
+			return i, xsdMismatch(fmt.Sprintf("%s has unexpected <%s>", at, children[i].name))
+		}
+		return i, xsdMismatch(fmt.Sprintf("%s is missing %s", at, particleName(p)))
+	}
+	return i, nil
+}
+
+// An xsdMismatch is when the children do not fit a particle, as opposed to a
+// child which fits but is itself invalid
+type xsdMismatch string
+
+func (e xsdMismatch) Error() string { return string(e) }
+
+// once matches a single occurrence of a particle
+func (s *xsdSchema) once(children []*xmlNode, i int, p *xmlNode, at string) (int, bool, error) {
+	switch p.name {
+	case "element":
+		decl := p
+		if ref := localName(p.attr("ref")); ref != "" {
+			decl = s.elements[ref]
+			if decl == nil {
+				return i, false, fmt.Errorf("Unknown element reference %q", ref)
+			}
+		}
+		if i >= len(children) || children[i].name != decl.attr("name") {
+			return i, false, nil
+		}
+		c := children[i]
+		return i + 1, true, s.element(c, decl, fmt.Sprintf("%s/%s[%d]", at, c.name, i+1))
+	case "any":
+		if i >= len(children) {
+			return i, false, nil
+		}
+		// Strict needs a global declaration to validate against, lax only
+		// validates when there is one
+		c := children[i]
+		decl, pc := s.elements[c.name], p.attr("processContents")
+		switch {
+		case pc == "skip":
+		case decl != nil:
+			return i + 1, true, s.element(c, decl, fmt.Sprintf("%s/%s[%d]", at, c.name, i+1))
+		case pc != "lax":
+			return i, false, fmt.Errorf("%s has undeclared <%s>", at, c.name)
+		}
+		return i + 1, true, nil
+	case "sequence":
+		start := i
+		for _, c := range p.children {
+			if !isParticle(c) {
+				continue
+			}
+			var err error
+			if i, err = s.particle(children, i, c, at); err != nil {
+				if _, ok := err.(xsdMismatch); ok && i == start {
+					return start, false, nil
+				}
+				return i, false, err
+			}
+		}
+		return i, true, nil
+	case "choice":
+		for _, c := range p.children {
+			if !isParticle(c) {
+				continue
+			}
+			next, err := s.particle(children, i, c, at)
+			if _, ok := err.(xsdMismatch); err != nil && (!ok || next > i) {
+				return next, false, err
+			} else if err == nil && next > i {
+				return next, true, nil
+			}
+		}
+		// An alternative which may be empty
+		for _, c := range p.children {
+			if isParticle(c) {
+				if min, _ := occurs(c); min == 0 {
+					return i, true, nil
+				}
+			}
+		}
+		return i, false, nil
+	case "all":
+		seen := make(map[string]bool)
+		for i < len(children) {
+			matched := false
+			for _, c := range p.children {
+				if c.name != "element" || c.attr("name") != children[i].name || seen[children[i].name] {
+					continue
+				}
+				if err := s.element(children[i], c, at+"/"+children[i].name); err != nil {
+					return i, false, err
+				}
+				seen[children[i].name], matched = true, true
+				break
+			}
+			if !matched {
+				break
+			}
+			i++
+		}
+		for _, c := range p.children {
+			if min, _ := occurs(c); c.name == "element" && min > 0 && !seen[c.attr("name")] {
+				return i, false, fmt.Errorf("%s is missing <%s>", at, c.attr("name"))
+			}
+		}
+		return i, true, nil
+	}
+	return i, false, nil
+}
+
+func isParticle(n *xmlNode) bool {
+	switch n.name {
+	case "element", "any", "sequence", "choice", "all":
+		return true
+	}
+	return false
+}
+
+func particleName(p *xmlNode) string {
+	if p.name == "element" {
+		if name := p.attr("name"); name != "" {
+			return "<" + name + ">"
+		}
+		return "<" + localName(p.attr("ref")) + ">"
+	}
+	return "a " + p.name
+}
+
+// simple checks text against a named simple type, built in or declared
+func (s *xsdSchema) simple(val, name, at string) error {
+	if st, ok := s.simpleTypes[name]; ok {
+		return s.simpleType(val, st, at)
+	}
+	if err := xsdBuiltin(val, name); err != nil {
+		return fmt.Errorf("%s %v", at, err)
+	}
+	return nil
+}
+
+// simpleType checks text against a simpleType declaration
+func (s *xsdSchema) simpleType(val string, st *xmlNode, at string) error {
+	for _, r := range st.children {
+		switch r.name {
+		case "list":
+			for _, item := range strings.Fields(val) {
+				if err := s.member(item, r, "itemType", at); err != nil {
+					return err
+				}
+			}
+			continue
+		case "union":
+			if s.member(val, r, "memberTypes", at) != nil {
+				return fmt.Errorf("%s value %q matches no member of the union", at, val)
+			}
+			continue
+		case "restriction":
+		default:
+			continue
+		}
+		if base := r.attr("base"); base != "" {
+			if err := s.simple(val, localName(base), at); err != nil {
+				return err
+			}
+		}
+		var enums []string
+		for _, f := range r.children {
+			v := f.attr("value")
+			n, _ := strconv.Atoi(v)
+			num, numErr := strconv.ParseFloat(val, 64)
+			limit, _ := strconv.ParseFloat(v, 64)
+			length := len([]rune(val))
+			bad := false
+			switch f.name {
+			case "enumeration":
+				enums = append(enums, v)
+			case "pattern":
+				bad = !s.patterns[v].MatchString(val)
+			case "length":
+				bad = length != n
+			case "minLength":
+				bad = length < n
+			case "maxLength":
+				bad = length > n
+			case "minInclusive":
+				bad = numErr != nil || num < limit
+			case "maxInclusive":
+				bad = numErr != nil || num > limit
+			case "minExclusive":
+				bad = numErr != nil || num <= limit
+			case "maxExclusive":
+				bad = numErr != nil || num >= limit
+			}
+			if bad {
+				return fmt.Errorf("%s value %q fails %s %q", at, val, f.name, v)
+			}
+		}
+		if len(enums) > 0 && !hasString(enums, val) {
+			return fmt.Errorf("%s value %q is not one of %q", at, val, enums)
+		}
+	}
+	return nil
+}
+
+// member checks text against the types of a list or union, named in attr or
+// inline, and is satisfied by any one of them
+func (s *xsdSchema) member(val string, r *xmlNode, attr, at string) (err error) {
+	for _, t := range strings.Fields(r.attr(attr)) {
+		if err = s.simple(val, localName(t), at); err == nil {
+			return
+		}
+	}
+	for _, c := range r.children {
+		if c.name == "simpleType" {
+			if err = s.simpleType(val, c, at); err == nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// xsdBuiltins are the built in types which may be used, the ones not checked
+// by xsdBuiltin take any text
+var xsdBuiltins = map[string]bool{
+	"string": true, "normalizedString": true, "token": true, "language": true, "Name": true, "NCName": true,
+	"NMTOKEN": true, "ID": true, "IDREF": true, "ENTITY": true, "anyURI": true, "QName": true, "anySimpleType": true,
+	"integer": true, "int": true, "long": true, "short": true, "byte": true, "nonNegativeInteger": true,
+	"unsignedInt": true, "unsignedLong": true, "unsignedShort": true, "unsignedByte": true, "positiveInteger": true,
+	"decimal": true, "float": true, "double": true, "boolean": true, "date": true, "dateTime": true,
+}
+
+// xsdBuiltin checks text against the built in types
+func xsdBuiltin(val, name string) (err error) {
+	switch name {
+	case "integer", "int", "long", "short", "byte":
+		_, err = strconv.ParseInt(val, 10, 64)
+	case "nonNegativeInteger", "unsignedInt", "unsignedLong", "unsignedShort", "unsignedByte":
+		_, err = strconv.ParseUint(val, 10, 64)
+	case "positiveInteger":
+		var n uint64
+		if n, err = strconv.ParseUint(val, 10, 64); err == nil && n == 0 {
+			err = fmt.Errorf("zero")
+		}
+	case "decimal", "float", "double":
+		_, err = strconv.ParseFloat(val, 64)
+	case "boolean":
+		if val != "true" && val != "false" && val != "1" && val != "0" {
+			err = fmt.Errorf("not a boolean")
+		}
+	case "date":
+		if _, err = time.Parse("2006-01-02", val); err != nil {
+			_, err = time.Parse("2006-01-02Z07:00", val)
+		}
+	case "dateTime":
+		if _, err = time.Parse(time.RFC3339Nano, val); err != nil {
+			_, err = time.Parse("2006-01-02T15:04:05", val)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("value %q is not a valid %s", val, name)
+	}
+	return nil
+}
+
+func localName(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
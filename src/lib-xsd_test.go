@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testXSDHead = `<?xml version="1.0"?>
+<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+`
+
+func testXSD(t *testing.T, body string) (*xsdSchema, error) {
+	t.Helper()
+	fp := filepath.Join(t.TempDir(), "schema.xsd")
+	if err := os.WriteFile(fp, []byte(testXSDHead+body+"</xs:schema>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadXSD(fp)
+}
+
+func TestXSDLoad(t *testing.T) {
+	tests := []struct {
+		name, body, err string
+	}{
+		{"simple", `<xs:element name="a" type="xs:string"><xs:annotation><xs:documentation><b>any</b></xs:documentation></xs:annotation></xs:element>`, ""},
+		{"include", `<xs:include schemaLocation="other.xsd"/><xs:element name="a"/>`, "<include>"},
+		{"import", `<xs:import namespace="urn:x"/><xs:element name="a"/>`, "<import>"},
+		{"complexContent", `<xs:complexType name="t"><xs:complexContent><xs:extension base="u"/></xs:complexContent></xs:complexType><xs:element name="a" type="t"/>`, "<complexContent>"},
+		{"group", `<xs:group name="g"><xs:sequence/></xs:group><xs:element name="a"/>`, "<group>"},
+		{"group ref", `<xs:element name="a"><xs:complexType><xs:sequence><xs:group ref="g"/></xs:sequence></xs:complexType></xs:element>`, "<group>"},
+		{"attributeGroup", `<xs:element name="a"><xs:complexType><xs:attributeGroup ref="g"/></xs:complexType></xs:element>`, "<attributeGroup>"},
+		{"identity constraint", `<xs:element name="a"><xs:unique name="u"><xs:selector xpath="b"/><xs:field xpath="@id"/></xs:unique></xs:element>`, "<unique>"},
+		{"fixed element", `<xs:element name="a" type="xs:string" fixed="x"/>`, "fixed"},
+		{"nillable element", `<xs:element name="a" type="xs:string" nillable="true"/>`, "nillable"},
+		{"attribute ref", `<xs:element name="a"><xs:complexType><xs:attribute ref="x"/></xs:complexType></xs:element>`, "ref"},
+		{"unknown type", `<xs:element name="a" type="xs:duration"/>`, "Unknown type"},
+		{"undeclared type", `<xs:element name="a" type="myType"/>`, "Unknown type"},
+		{"unknown element ref", `<xs:element name="a"><xs:complexType><xs:sequence><xs:element ref="b"/></xs:sequence></xs:complexType></xs:element>`, "Unknown element"},
+		{"unsupported facet", `<xs:simpleType name="t"><xs:restriction base="xs:decimal"><xs:totalDigits value="3"/></xs:restriction></xs:simpleType><xs:element name="a" type="t"/>`, "<totalDigits>"},
+		{"simpleContent restriction", `<xs:complexType name="t"><xs:simpleContent><xs:restriction base="u"/></xs:simpleContent></xs:complexType><xs:element name="a" type="t"/>`, "<restriction>"},
+		{"restriction of a list", `<xs:simpleType name="l"><xs:list itemType="xs:int"/></xs:simpleType><xs:simpleType name="t"><xs:restriction base="l"><xs:length value="2"/></xs:restriction></xs:simpleType><xs:element name="a" type="t"/>`, "list type"},
+		{"empty union", `<xs:simpleType name="t"><xs:union/></xs:simpleType><xs:element name="a" type="t"/>`, "Union without"},
+		{"bad pattern", `<xs:simpleType name="t"><xs:restriction base="xs:string"><xs:pattern value="("/></xs:restriction></xs:simpleType><xs:element name="a" type="t"/>`, "missing closing"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := testXSD(t, tc.body)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("Expected an error with %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestXSDValidate(t *testing.T) {
+	s, err := testXSD(t, `
+  <xs:simpleType name="code">
+    <xs:restriction base="xs:string">
+      <xs:pattern value="[A-Z]{3}"/>
+    </xs:restriction>
+  </xs:simpleType>
+  <xs:simpleType name="codes">
+    <xs:list itemType="code"/>
+  </xs:simpleType>
+  <xs:simpleType name="sizeOrAuto">
+    <xs:union memberTypes="xs:positiveInteger">
+      <xs:simpleType>
+        <xs:restriction base="xs:string">
+          <xs:enumeration value="auto"/>
+        </xs:restriction>
+      </xs:simpleType>
+    </xs:union>
+  </xs:simpleType>
+  <xs:element name="note" type="xs:string"/>
+  <xs:element name="order">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element name="item" maxOccurs="unbounded">
+          <xs:complexType>
+            <xs:simpleContent>
+              <xs:extension base="xs:int">
+                <xs:attribute name="unit" type="code" use="required"/>
+              </xs:extension>
+            </xs:simpleContent>
+          </xs:complexType>
+        </xs:element>
+        <xs:element name="ship" type="codes" minOccurs="0"/>
+        <xs:element name="size" type="sizeOrAuto" minOccurs="0"/>
+        <xs:any minOccurs="0"/>
+      </xs:sequence>
+      <xs:attribute name="id" type="xs:positiveInteger"/>
+    </xs:complexType>
+  </xs:element>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &validation{MaxDepth: 64}
+
+	tests := []struct {
+		name, doc, err string
+	}{
+		{"valid", `<order id="1"><item unit="KGM">3</item><ship>USA GBR</ship><size>auto</size><note>hi</note></order>`, ""},
+		{"union member type", `<order><item unit="KGM">3</item><size>12</size></order>`, ""},
+		{"union mismatch", `<order><item unit="KGM">3</item><size>big</size></order>`, "no member of the union"},
+		{"list item", `<order><item unit="KGM">3</item><ship>USA gb</ship></order>`, `"gb" fails pattern`},
+		{"missing item", `<order><ship>USA</ship></order>`, "unexpected <ship>"},
+		{"missing attribute", `<order><item>3</item></order>`, "missing @unit"},
+		{"unexpected attribute", `<order other="x"><item unit="KGM">3</item></order>`, "unexpected @other"},
+		{"simple content type", `<order><item unit="KGM">three</item></order>`, "not a valid int"},
+		{"strict any undeclared", `<order><item unit="KGM">3</item><other/></order>`, "undeclared <other>"},
+		{"strict any invalid", `<order><item unit="KGM">3</item><note><b/></note></order>`, "should only have text"},
+		{"wrong root", `<invoice/>`, "Unexpected root"},
+		{"doctype", `<!DOCTYPE order><order/>`, "DOCTYPE"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := v.checkXML(strings.NewReader(tc.doc), s)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("Expected an error with %q, got %v", tc.err, err)
+			}
+		})
+	}
+}